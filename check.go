@@ -0,0 +1,88 @@
+/**
+* Filename: check.go
+* Description: the "portforward check-config" subcommand, it loads the
+*   rule configuration file and checks every rule without running it, so
+*   that the file can be verified before launching or reloading by SIGHUP.
+* Author: knownsec404
+* Time: 2020.10.23
+*/
+
+package main
+
+import (
+    "flag"
+    "fmt"
+    "os"
+    "text/tabwriter"
+
+    "github.com/knownsec/PortForward/forward"
+)
+
+
+/**********************************************************************
+* @Function: checkConfig(args []string) (int)
+* @Description: run the check-config subcommand, print the checked rules
+*   or the first invalid one
+* @Parameter: args []string, the arguments after "check-config"
+* @Return: int, the exit code, 1 if the config is invalid
+**********************************************************************/
+func checkConfig(args []string) (int) {
+    flags := flag.NewFlagSet("check-config", flag.ContinueOnError)
+    config := flags.String("c", "", "")
+    quiet := flags.Bool("q", false, "")
+    flags.Usage = checkConfigUsage
+    if flags.Parse(args) != nil {
+        return 2
+    }
+    // the config is given by "-c" or argument
+    if *config == "" && flags.NArg() == 1 {
+        *config = flags.Arg(0)
+    } else if *config == "" || flags.NArg() != 0 {
+        checkConfigUsage()
+        return 2
+    }
+
+    rules, err := forward.LoadConfig(*config)
+    if err != nil {
+        fmt.Fprintln(os.Stderr, err)
+        return 1
+    }
+    if *quiet {
+        return 0
+    }
+
+    w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+    fmt.Fprintln(w, "NAME\tPROTO\tSOCK1\tSOCK2\tLOG")
+    for _, rule := range rules {
+        level := rule.LogLevel
+        if level == "" {
+            level = "-"
+        }
+        fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", rule.Name,
+                    forward.FormatProto(rule.Protocol),
+                    rule.Endpoint(1), rule.Endpoint(2), level)
+    }
+    w.Flush()
+    fmt.Printf("config [%s] is ok, %d rules\n", *config, len(rules))
+    return 0
+}
+
+
+/**********************************************************************
+* @Function: checkConfigUsage()
+* @Description: the usage of "check-config" subcommand
+* @Parameter: nil
+* @Return: nil
+**********************************************************************/
+func checkConfigUsage() {
+    fmt.Println("Usage:")
+    fmt.Println("  ./portforward check-config [-q] [config]")
+    fmt.Println("  ./portforward check-config [-q] -c [config]")
+    fmt.Println("Option:")
+    fmt.Println("  config     the json rule configuration file")
+    fmt.Println("  q          print nothing but the error, the exit code is 1 if")
+    fmt.Println("             the config is invalid")
+    fmt.Println("Example:")
+    fmt.Println("  check-config rules.json")
+    fmt.Println("  check-config -q rules.json && kill -HUP `pidof portforward`")
+}
@@ -0,0 +1,305 @@
+/**
+* Filename: ctl.go
+* Description: the "portforward ctl" subcommand, it controls a running
+*   PortForward process through its admin API, and prints the result as
+*   table or json.
+* Author: knownsec404
+* Time: 2020.10.23
+*/
+
+package main
+
+import (
+    "encoding/json"
+    "flag"
+    "fmt"
+    "os"
+    "strconv"
+    "strings"
+    "text/tabwriter"
+    "time"
+
+    "github.com/knownsec/PortForward/forward"
+)
+
+
+/**********************************************************************
+* @Function: ctl(args []string) (int)
+* @Description: run the ctl subcommand
+* @Parameter: args []string, the arguments after "ctl"
+* @Return: int, the exit code
+**********************************************************************/
+func ctl(args []string) (int) {
+    flags := flag.NewFlagSet("ctl", flag.ContinueOnError)
+    admin := flags.String("admin", "", "")
+    tokenFile := flags.String("admin-token", "", "")
+    asJSON := flags.Bool("json", false, "")
+    flags.Usage = ctlUsage
+    if flags.Parse(args) != nil {
+        return 2
+    }
+    // the process has no admin API by default, so there is no default
+    if *admin == "" || flags.NArg() == 0 {
+        ctlUsage()
+        return 2
+    }
+
+    client := forward.NewAdminClient(*admin)
+    if *tokenFile != "" {
+        token, err := forward.LoadAdminToken(*tokenFile, false)
+        if err != nil {
+            fmt.Fprintln(os.Stderr, err)
+            return 1
+        }
+        client.SetToken(token)
+    }
+    result, err := ctlRun(client, flags.Arg(0), flags.Args()[1:])
+    if err != nil {
+        if err == flag.ErrHelp {
+            ctlUsage()
+            return 2
+        }
+        fmt.Fprintln(os.Stderr, err)
+        return 1
+    }
+
+    if *asJSON {
+        data, _ := json.MarshalIndent(result, "", "  ")
+        fmt.Println(string(data))
+        return 0
+    }
+    ctlPrint(result)
+    return 0
+}
+
+
+/**********************************************************************
+* @Function: ctlRun(client *forward.AdminClient, command string,
+*   args []string) (interface{}, error)
+* @Description: run the ctl command
+* @Parameter: client *forward.AdminClient, the admin client
+* @Parameter: command string, the command
+* @Parameter: args []string, the arguments of command
+* @Return: (interface{}, error), the result and error, flag.ErrHelp if the
+*   arguments are invalid
+**********************************************************************/
+func ctlRun(client *forward.AdminClient, command string,
+    args []string) (interface{}, error) {
+    switch {
+    case command == "ls" && len(args) == 0:
+        return client.Rules()
+    case command == "links" && len(args) == 0:
+        return client.AllLinks()
+    case command == "links" && len(args) == 1:
+        return client.Links(args[0])
+    case command == "kill" && len(args) == 1:
+        return ctlKill(client, args[0])
+    case command == "add":
+        return ctlAdd(client, args)
+    case command == "rm" && len(args) == 1:
+        err := client.Remove(args[0])
+        if err != nil {
+            return nil, err
+        }
+        return map[string]string{"name": args[0]}, nil
+    case command == "pause" && len(args) == 1:
+        return client.Pause(args[0])
+    case command == "resume" && len(args) == 1:
+        return client.Resume(args[0])
+    case command == "loglevel" && len(args) == 0:
+        level, err := client.LogLevel()
+        return map[string]string{"level": level}, err
+    case command == "loglevel" && len(args) == 1:
+        level, err := client.SetLogLevel(args[0])
+        return map[string]string{"level": level}, err
+    }
+    return nil, flag.ErrHelp
+}
+
+
+/**********************************************************************
+* @Function: ctlKill(client *forward.AdminClient, link string)
+*   (interface{}, error)
+* @Description: close the active link, the link is "id" or "rule/id", the
+*   rule can be omitted if the id is unique among all rules
+* @Parameter: client *forward.AdminClient, the admin client
+* @Parameter: link string, the link
+* @Return: (interface{}, error), the closed link and error
+**********************************************************************/
+func ctlKill(client *forward.AdminClient, link string) (interface{}, error) {
+    i := strings.LastIndex(link, "/")
+    id, err := strconv.Atoi(link[i + 1:])
+    if err != nil {
+        return nil, fmt.Errorf("invalid link id [%s]", link[i + 1:])
+    }
+
+    var found *forward.LinkStatus
+    if i >= 0 {
+        links, err := client.Links(link[:i])
+        if err != nil {
+            return nil, err
+        }
+        for j := range links {
+            if links[j].Id == id {
+                found = &links[j]
+            }
+        }
+    } else {
+        links, err := client.AllLinks()
+        if err != nil {
+            return nil, err
+        }
+        for j := range links {
+            if links[j].Id != id {
+                continue
+            }
+            if found != nil {
+                return nil, fmt.Errorf("link%d exists in rule [%s] and [%s], " +
+                                       "use \"rule/id\"", id, found.Rule,
+                                       links[j].Rule)
+            }
+            found = &links[j]
+        }
+    }
+    if found == nil {
+        return nil, fmt.Errorf("link [%s] not found", link)
+    }
+
+    err = client.CloseLink(found.Rule, found.Id)
+    if err != nil {
+        return nil, err
+    }
+    return []forward.LinkStatus{*found}, nil
+}
+
+
+/**********************************************************************
+* @Function: ctlAdd(client *forward.AdminClient, args []string)
+*   (interface{}, error)
+* @Description: add rule, "[-name name] [proto] sock1 sock2", the name is
+*   sock1 by default, the proto can be omitted if both socks have it
+* @Parameter: client *forward.AdminClient, the admin client
+* @Parameter: args []string, the arguments of command
+* @Return: (interface{}, error), the status of rule and error
+**********************************************************************/
+func ctlAdd(client *forward.AdminClient, args []string) (interface{}, error) {
+    flags := flag.NewFlagSet("add", flag.ContinueOnError)
+    flags.SetOutput(os.Stderr)
+    flags.Usage = func() {}
+    name := flags.String("name", "", "")
+    if flags.Parse(args) != nil || (flags.NArg() != 2 && flags.NArg() != 3) {
+        return nil, flag.ErrHelp
+    }
+
+    // the protocol can be omitted if both socks have it
+    socks := flags.Args()
+    rule := forward.RuleConfig{Name: *name}
+    if flags.NArg() == 3 {
+        rule.Proto, socks = flags.Arg(0), flags.Args()[1:]
+    }
+    rule.Sock1, rule.Sock2 = socks[0], socks[1]
+    if rule.Name == "" {
+        rule.Name = rule.Sock1
+    }
+    return client.Add(rule)
+}
+
+
+/**********************************************************************
+* @Function: ctlPrint(result interface{})
+* @Description: print the result as table
+* @Parameter: result interface{}, the result of ctl command
+* @Return: nil
+**********************************************************************/
+func ctlPrint(result interface{}) {
+    w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+    defer w.Flush()
+
+    switch v := result.(type) {
+    case forward.RuleStatus:
+        ctlPrint([]forward.RuleStatus{v})
+    case []forward.RuleStatus:
+        fmt.Fprintln(w, "NAME\tPROTO\tSOCK1\tSOCK2\tSTATE\tACTIVE\tLINKS\tUP\tDOWN")
+        for _, r := range v {
+            fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%d\t%d\t%d\t%d\n",
+                        ctlName(r.Name), r.Proto, r.Sock1, r.Sock2, r.State,
+                        r.Stats.Active, r.Stats.Links, r.Stats.Up.Bytes,
+                        r.Stats.Down.Bytes)
+        }
+    case []forward.LinkStatus:
+        fmt.Fprintln(w, "RULE\tID\tA\tB\tUP\tDOWN\tAGE")
+        for _, l := range v {
+            age := time.Duration(l.Age * float64(time.Second))
+            fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%d\t%d\t%s\n", ctlName(l.Rule),
+                        l.Id, l.Addr1, l.Addr2, l.Up.Bytes, l.Down.Bytes,
+                        age.Round(time.Second))
+        }
+    case map[string]string:
+        for key, value := range v {
+            fmt.Fprintf(w, "%s\t%s\n", strings.ToUpper(key), value)
+        }
+    default:
+        fmt.Fprintln(w, v)
+    }
+}
+
+
+/**********************************************************************
+* @Function: ctlName(name string) (string)
+* @Description: get the printable rule name, the rule of command-line has
+*   no name
+* @Parameter: name string, the rule name
+* @Return: string, the printable rule name
+**********************************************************************/
+func ctlName(name string) (string) {
+    if name == "" {
+        return "-"
+    }
+    return name
+}
+
+
+/**********************************************************************
+* @Function: ctlUsage()
+* @Description: the ctl subcommand usage
+* @Parameter: nil
+* @Return: nil
+**********************************************************************/
+func ctlUsage() {
+    fmt.Println("Usage:")
+    fmt.Println("  ./portforward ctl -admin address [-admin-token file] [-json]")
+    fmt.Println("                    [command]")
+    fmt.Println("Option:")
+    fmt.Println("  admin      the address of admin API of the running process, it")
+    fmt.Println("             is required, the same as \"run -admin\"")
+    fmt.Println("  admin-token")
+    fmt.Println("             the token file of admin API, the same as the one of")
+    fmt.Println("             the running process")
+    fmt.Println("  json       print the result as json instead of table")
+    fmt.Println("Command:")
+    fmt.Println("  ls         list rules")
+    fmt.Println("  links [rule]")
+    fmt.Println("             list the active links of rule or all rules")
+    fmt.Println("  kill [rule/]id")
+    fmt.Println("             close the active link, the rule can be omitted")
+    fmt.Println("             if the id is unique")
+    fmt.Println("  add [-name name] [proto] [sock1] [sock2]")
+    fmt.Println("             add rule, the name is sock1 by default, the proto")
+    fmt.Println("             can be omitted if both socks are URI with it")
+    fmt.Println("  rm [rule]  remove rule, its links are drained within the")
+    fmt.Println("             grace period of the running process")
+    fmt.Println("  pause [rule]")
+    fmt.Println("             pause rule, it is shut down like removing but")
+    fmt.Println("             kept in the rule set")
+    fmt.Println("  resume [rule]")
+    fmt.Println("             resume the paused rule")
+    fmt.Println("  loglevel [level]")
+    fmt.Println("             get or set the log level(debug/info/warn/error)")
+    fmt.Println("Example:")
+    fmt.Println("  ctl -admin unix:/tmp/portforward.sock ls")
+    fmt.Println("  ctl -admin unix:/tmp/portforward.sock -json links rdp")
+    fmt.Println("  ctl -admin unix:/tmp/portforward.sock kill rdp/3")
+    fmt.Println("  ctl -admin unix:/tmp/portforward.sock add -name web tcp \\")
+    fmt.Println("      listen:0.0.0.0:8080 conn:192.168.1.10:80")
+    fmt.Println("  ctl -admin unix:/tmp/portforward.sock loglevel debug")
+}
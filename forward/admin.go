@@ -0,0 +1,434 @@
+/**
+* Filename: admin.go
+* Description: the PortForward admin API, it is a local HTTP/JSON service
+*   on unix socket or loopback address to control the rule manager at
+*   runtime:
+*   GET    /rules                    list rules
+*   POST   /rules                    add rule, the body is the rule of config
+*   GET    /rules/{name}             get rule
+*   DELETE /rules/{name}             remove rule
+*   POST   /rules/{name}/pause       pause rule
+*   POST   /rules/{name}/resume      resume rule
+*   GET    /rules/{name}/links       list active links of rule
+*   DELETE /rules/{name}/links/{id}  close link
+*   GET    /links                    list active links of all rules
+*   GET    /log                      get log level
+*   PUT    /log                      set log level, {"level": "debug"}
+*   the requests from browser are refused: the request with "Origin" header
+*   or non-loopback "Host" is forbidden, and the request except GET must be
+*   "Content-Type: application/json", so that a web page can not send it
+*   without CORS preflight. the optional token is required by
+*   "Authorization: Bearer <token>" for the loopback address.
+* Author: knownsec404
+* Time: 2020.10.23
+*/
+
+package forward
+
+import (
+    "crypto/rand"
+    "crypto/subtle"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io/ioutil"
+    "mime"
+    "net"
+    "net/http"
+    "net/url"
+    "os"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// the active link in admin API
+type LinkStatus struct {
+    LinkStats
+    // the seconds since the link is connected
+    Age         float64     `json:"age"`
+}
+
+// the log level in admin API
+type adminLog struct {
+    Level       string      `json:"level"`
+}
+
+// the error in admin API
+type adminError struct {
+    Error       string      `json:"error"`
+}
+
+// the error with http status code
+type adminStatus struct {
+    code        int
+    message     string
+}
+
+func (this *adminStatus) Error() (string) { return this.message }
+
+
+/**********************************************************************
+* @Function: ListenAdmin(address string) (net.Listener, error)
+* @Description: listen the admin API, the address is "unix:/path/to/sock"
+*   or the loopback "ip:port", the other address is refused. the socket of
+*   running process is refused, only the stale one is removed
+* @Parameter: address string, the listen address
+* @Return: (net.Listener, error), the listener and error
+**********************************************************************/
+func ListenAdmin(address string) (net.Listener, error) {
+    if strings.HasPrefix(address, "unix:") {
+        path := strings.TrimPrefix(address, "unix:")
+        if info, err := os.Stat(path); err == nil &&
+           info.Mode() & os.ModeSocket != 0 {
+            conn, err := net.DialTimeout("unix", path, time.Second)
+            if err == nil {
+                conn.Close()
+                return nil, fmt.Errorf("admin socket [%s] is in use", path)
+            }
+            // remove the socket left by the last process
+            os.Remove(path)
+        }
+        l, err := net.Listen("unix", path)
+        if err != nil {
+            return nil, err
+        }
+        err = os.Chmod(path, 0600)
+        if err != nil {
+            l.Close()
+            return nil, err
+        }
+        return l, nil
+    }
+
+    host, _, err := net.SplitHostPort(address)
+    if err != nil {
+        return nil, err
+    }
+    ip := net.ParseIP(host)
+    if host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+        return nil, fmt.Errorf("admin address [%s] is not loopback", address)
+    }
+    return net.Listen("tcp", address)
+}
+
+
+/**********************************************************************
+* @Function: AdminHandler(manager *Manager) (http.Handler)
+* @Description: get the http handler of admin API
+* @Parameter: manager *Manager, the rule manager
+* @Return: http.Handler, the http handler
+**********************************************************************/
+func AdminHandler(manager *Manager) (http.Handler) {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        // split the path, the rule name may be escaped
+        items := strings.Split(strings.Trim(r.URL.EscapedPath(), "/"), "/")
+        for i, item := range items {
+            items[i], _ = url.PathUnescape(item)
+        }
+
+        var data interface{}
+        err := adminCheck(r)
+        switch {
+        case err != nil:
+        case len(items) == 1 && items[0] == "rules":
+            data, err = adminRules(manager, r)
+        case len(items) >= 2 && items[0] == "rules":
+            data, err = adminRule(manager, r, items[1], items[2:])
+        case len(items) == 1 && items[0] == "links":
+            data, err = adminLinks(manager, r, "")
+        case len(items) == 1 && items[0] == "log":
+            data, err = adminLogLevel(r)
+        default:
+            err = &adminStatus{http.StatusNotFound, "not found"}
+        }
+
+        w.Header().Set("Content-Type", "application/json")
+        if err != nil {
+            code := http.StatusBadRequest
+            if e, ok := err.(*adminStatus); ok {
+                code = e.code
+            }
+            w.WriteHeader(code)
+            data = adminError{Error: err.Error()}
+        }
+        json.NewEncoder(w).Encode(data)
+    })
+}
+
+
+/**********************************************************************
+* @Function: adminCheck(r *http.Request) (error)
+* @Description: refuse the request from browser, such as the cross-site
+*   request of web page and DNS rebinding
+* @Parameter: r *http.Request, the request
+* @Return: error, the error with status 403 or 415
+**********************************************************************/
+func adminCheck(r *http.Request) (error) {
+    if r.Header.Get("Origin") != "" {
+        return &adminStatus{http.StatusForbidden, "cross-origin request"}
+    }
+    host := r.Host
+    if h, _, err := net.SplitHostPort(host); err == nil {
+        host = h
+    }
+    ip := net.ParseIP(strings.Trim(host, "[]"))
+    if host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+        return &adminStatus{http.StatusForbidden,
+                            fmt.Sprintf("host [%s] is not loopback", r.Host)}
+    }
+    if r.Method == http.MethodGet || r.Method == http.MethodHead {
+        return nil
+    }
+    mediatype, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+    if err != nil || mediatype != "application/json" {
+        return &adminStatus{http.StatusUnsupportedMediaType,
+                            "content type must be application/json"}
+    }
+    return nil
+}
+
+
+/**********************************************************************
+* @Function: AdminTokenHandler(handler http.Handler, token string)
+*   (http.Handler)
+* @Description: wrap the handler of admin API, the request must carry the
+*   token by "Authorization: Bearer <token>"
+* @Parameter: handler http.Handler, the handler of admin API
+* @Parameter: token string, the token
+* @Return: http.Handler, the http handler with token
+**********************************************************************/
+func AdminTokenHandler(handler http.Handler, token string) (http.Handler) {
+    want := []byte("Bearer " + token)
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        got := []byte(r.Header.Get("Authorization"))
+        if subtle.ConstantTimeCompare(got, want) != 1 {
+            w.Header().Set("Content-Type", "application/json")
+            w.WriteHeader(http.StatusUnauthorized)
+            json.NewEncoder(w).Encode(adminError{Error: "invalid token"})
+            return
+        }
+        handler.ServeHTTP(w, r)
+    })
+}
+
+
+/**********************************************************************
+* @Function: LoadAdminToken(path string, create bool) (string, error)
+* @Description: read the token of admin API from file, the random token is
+*   generated and written to the file (mode 0600) if it does not exist
+* @Parameter: path string, the token file
+* @Parameter: create bool, create the file if it does not exist
+* @Return: (string, error), the token and error
+**********************************************************************/
+func LoadAdminToken(path string, create bool) (string, error) {
+    data, err := ioutil.ReadFile(path)
+    if err == nil {
+        token := strings.TrimSpace(string(data))
+        if token == "" {
+            return "", fmt.Errorf("token file [%s] is empty", path)
+        }
+        return token, nil
+    }
+    if !os.IsNotExist(err) || !create {
+        return "", err
+    }
+
+    buf := make([]byte, 32)
+    _, err = rand.Read(buf)
+    if err != nil {
+        return "", err
+    }
+    token := hex.EncodeToString(buf)
+    err = ioutil.WriteFile(path, []byte(token + "\n"), 0600)
+    if err != nil {
+        return "", err
+    }
+    return token, nil
+}
+
+
+/**********************************************************************
+* @Function: adminRules(manager *Manager, r *http.Request) (interface{},
+*   error)
+* @Description: list rules, or add rule
+* @Parameter: manager *Manager, the rule manager
+* @Parameter: r *http.Request, the request
+* @Return: (interface{}, error), the response and error
+**********************************************************************/
+func adminRules(manager *Manager, r *http.Request) (interface{}, error) {
+    switch r.Method {
+    case http.MethodGet:
+        return manager.Rules(), nil
+    case http.MethodPost:
+        var rule RuleConfig
+        err := json.NewDecoder(r.Body).Decode(&rule)
+        if err != nil {
+            return nil, fmt.Errorf("parse rule error, %s", err)
+        }
+        if rule.Name == "" {
+            return nil, errors.New("rule name is empty")
+        }
+        args, err := parseRule(rule)
+        if err != nil {
+            return nil, err
+        }
+        err = manager.Add(args)
+        if err != nil {
+            return nil, &adminStatus{http.StatusConflict, err.Error()}
+        }
+        return adminFind(manager, rule.Name)
+    }
+    return nil, &adminStatus{http.StatusMethodNotAllowed, "method not allowed"}
+}
+
+
+/**********************************************************************
+* @Function: adminRule(manager *Manager, r *http.Request, name string,
+*   items []string) (interface{}, error)
+* @Description: get, remove, pause and resume rule, or the links of rule
+* @Parameter: manager *Manager, the rule manager
+* @Parameter: r *http.Request, the request
+* @Parameter: name string, the rule name
+* @Parameter: items []string, the path items after rule name
+* @Return: (interface{}, error), the response and error
+**********************************************************************/
+func adminRule(manager *Manager, r *http.Request, name string,
+    items []string) (interface{}, error) {
+    _, err := adminFind(manager, name)
+    if err != nil {
+        return nil, err
+    }
+
+    var action string
+    if len(items) > 0 {
+        action = items[0]
+    }
+    switch {
+    case action == "" && r.Method == http.MethodGet:
+        return adminFind(manager, name)
+    case action == "" && r.Method == http.MethodDelete:
+        err = manager.Remove(name)
+        if err != nil {
+            return nil, &adminStatus{http.StatusConflict, err.Error()}
+        }
+        return map[string]string{"name": name}, nil
+    case action == "pause" && len(items) == 1 && r.Method == http.MethodPost:
+        err = manager.Pause(name)
+    case action == "resume" && len(items) == 1 && r.Method == http.MethodPost:
+        err = manager.Resume(name)
+    case action == "links" && len(items) == 1:
+        return adminLinks(manager, r, name)
+    case action == "links" && len(items) == 2 && r.Method == http.MethodDelete:
+        id, e := strconv.Atoi(items[1])
+        if e != nil {
+            return nil, fmt.Errorf("invalid link id [%s]", items[1])
+        }
+        err = manager.CloseLink(name, id)
+        if err != nil {
+            return nil, &adminStatus{http.StatusNotFound, err.Error()}
+        }
+        return map[string]int{"id": id}, nil
+    case action == "" || action == "pause" || action == "resume" ||
+         action == "links":
+        return nil, &adminStatus{http.StatusMethodNotAllowed,
+                                 "method not allowed"}
+    default:
+        return nil, &adminStatus{http.StatusNotFound, "not found"}
+    }
+
+    if err != nil {
+        return nil, &adminStatus{http.StatusConflict, err.Error()}
+    }
+    return adminFind(manager, name)
+}
+
+
+/**********************************************************************
+* @Function: adminFind(manager *Manager, name string) (interface{}, error)
+* @Description: get the status of rule
+* @Parameter: manager *Manager, the rule manager
+* @Parameter: name string, the rule name
+* @Return: (interface{}, error), the rule status and error if not found
+**********************************************************************/
+func adminFind(manager *Manager, name string) (interface{}, error) {
+    for _, status := range manager.Rules() {
+        if status.Name == name {
+            return status, nil
+        }
+    }
+    return nil, &adminStatus{http.StatusNotFound,
+                             fmt.Sprintf("rule [%s] not found", name)}
+}
+
+
+/**********************************************************************
+* @Function: adminLinks(manager *Manager, r *http.Request, name string)
+*   (interface{}, error)
+* @Description: list the active links of rule or all rules
+* @Parameter: manager *Manager, the rule manager
+* @Parameter: r *http.Request, the request
+* @Parameter: name string, the rule name, empty means all rules
+* @Return: (interface{}, error), the active links and error
+**********************************************************************/
+func adminLinks(manager *Manager, r *http.Request, name string) (interface{},
+    error) {
+    if r.Method != http.MethodGet {
+        return nil, &adminStatus{http.StatusMethodNotAllowed,
+                                 "method not allowed"}
+    }
+    names := []string{name}
+    if name == "" {
+        names = names[:0]
+        for _, status := range manager.Rules() {
+            names = append(names, status.Name)
+        }
+    }
+
+    now := time.Now()
+    links := make([]LinkStatus, 0)
+    for _, n := range names {
+        stats, err := manager.Links(n)
+        if err != nil {
+            // the rule is removed meanwhile
+            continue
+        }
+        for _, s := range stats {
+            links = append(links, LinkStatus{
+                LinkStats:  s,
+                Age:        now.Sub(s.Start).Seconds(),
+            })
+        }
+    }
+    return links, nil
+}
+
+
+/**********************************************************************
+* @Function: adminLogLevel(r *http.Request) (interface{}, error)
+* @Description: get or set the log level
+* @Parameter: r *http.Request, the request
+* @Return: (interface{}, error), the log level and error
+**********************************************************************/
+func adminLogLevel(r *http.Request) (interface{}, error) {
+    switch r.Method {
+    case http.MethodGet:
+    case http.MethodPut, http.MethodPost:
+        var req adminLog
+        err := json.NewDecoder(r.Body).Decode(&req)
+        if err != nil {
+            return nil, fmt.Errorf("parse log level error, %s", err)
+        }
+        level, err := ParseLogLevel(req.Level)
+        if err != nil {
+            return nil, err
+        }
+        SetLogLevel(level)
+        LogInfo("log level is set to [%s]", LogLevelName(level))
+    default:
+        return nil, &adminStatus{http.StatusMethodNotAllowed,
+                                 "method not allowed"}
+    }
+    return adminLog{Level: LogLevelName(GetLogLevel())}, nil
+}
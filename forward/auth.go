@@ -0,0 +1,154 @@
+/**
+* Filename: auth.go
+* Description: the PortForward pre-shared-key authentication, an accepted
+*   socket must pass the HMAC challenge-response handshake before it is
+*   eligible for pairing, so that a stray connection can not hijack the
+*   reverse tunnel. The handshake is:
+*   1.listen => conn: "PFA1" + 32 bytes random challenge
+*   2.conn => listen: HMAC-SHA256(secret, "PFA1" + challenge)
+*   3.listen => conn: 0x01 if verified, otherwise the socket is closed
+* Author: knownsec404
+* Time: 2020.10.22
+*/
+
+package forward
+
+import (
+    "context"
+    "crypto/hmac"
+    "crypto/rand"
+    "crypto/sha256"
+    "errors"
+    "io"
+    "time"
+)
+
+const authMagic string = "PFA1"
+const authChallengeSize int = 32
+const authTimeout time.Duration = 10 * time.Second
+
+
+/**********************************************************************
+* @Function: AuthServer(conn Conn, secret string) (error)
+* @Description: send challenge and verify response on the accepted socket
+* @Parameter: conn Conn, the accepted socket
+* @Parameter: secret string, the pre-shared-key
+* @Return: error, nil if the peer is authenticated
+**********************************************************************/
+func AuthServer(conn Conn, secret string) (error) {
+    setDeadline(conn, time.Now().Add(authTimeout))
+    defer setDeadline(conn, time.Time{})
+
+    challenge := make([]byte, len(authMagic) + authChallengeSize)
+    copy(challenge, authMagic)
+    _, err := rand.Read(challenge[len(authMagic):])
+    if err != nil {
+        return err
+    }
+    _, err = conn.Write(challenge)
+    if err != nil {
+        return err
+    }
+
+    response := make([]byte, sha256.Size)
+    _, err = io.ReadFull(conn, response)
+    if err != nil {
+        return errors.New("auth response error, " + err.Error())
+    }
+    if !hmac.Equal(response, authSign(secret, challenge)) {
+        return errors.New("auth failed, invalid response")
+    }
+
+    _, err = conn.Write([]byte{0x01})
+    return err
+}
+
+
+/**********************************************************************
+* @Function: AuthClient(conn Conn, secret string) (error)
+* @Description: receive challenge and send response on the dialed socket
+* @Parameter: conn Conn, the dialed socket
+* @Parameter: secret string, the pre-shared-key
+* @Return: error, nil if the peer accepted the response
+**********************************************************************/
+func AuthClient(conn Conn, secret string) (error) {
+    setDeadline(conn, time.Now().Add(authTimeout))
+    defer setDeadline(conn, time.Time{})
+
+    challenge := make([]byte, len(authMagic) + authChallengeSize)
+    _, err := io.ReadFull(conn, challenge)
+    if err != nil {
+        return errors.New("auth challenge error, " + err.Error())
+    }
+    if string(challenge[:len(authMagic)]) != authMagic {
+        return errors.New("auth challenge error, invalid magic")
+    }
+    _, err = conn.Write(authSign(secret, challenge))
+    if err != nil {
+        return err
+    }
+
+    result := make([]byte, 1)
+    _, err = io.ReadFull(conn, result)
+    if err != nil || result[0] != 0x01 {
+        return errors.New("auth rejected by peer")
+    }
+    return nil
+}
+
+
+/**********************************************************************
+* @Function: ListenAuth(listen ListenFunc, secret string) (ListenFunc)
+* @Description: wrap the listen function, the accepted socket is returned
+*   only after it passed the authentication
+* @Parameter: listen ListenFunc, the underlying listen function
+* @Parameter: secret string, the pre-shared-key
+* @Return: ListenFunc, the listen function with authentication
+**********************************************************************/
+func ListenAuth(listen ListenFunc, secret string) (ListenFunc) {
+    handshake := func(conn Conn) (Conn, error) {
+        return conn, AuthServer(conn, secret)
+    }
+    return func(ctx context.Context, address string, clientc chan Conn,
+        logger Logger) {
+        ListenHandshake(ctx, address, clientc, logger, listen, handshake)
+    }
+}
+
+
+/**********************************************************************
+* @Function: ConnAuth(dial DialFunc, secret string) (DialFunc)
+* @Description: wrap the dial function, the dialed socket is returned only
+*   after it passed the authentication
+* @Parameter: dial DialFunc, the underlying dial function
+* @Parameter: secret string, the pre-shared-key
+* @Return: DialFunc, the dial function with authentication
+**********************************************************************/
+func ConnAuth(dial DialFunc, secret string) (DialFunc) {
+    return func(address string) (Conn, error) {
+        conn, err := dial(address)
+        if err != nil {
+            return nil, err
+        }
+        err = AuthClient(conn, secret)
+        if err != nil {
+            conn.Close()
+            return nil, err
+        }
+        return conn, nil
+    }
+}
+
+
+/**********************************************************************
+* @Function: authSign(secret string, challenge []byte) ([]byte)
+* @Description: sign the challenge with pre-shared-key
+* @Parameter: secret string, the pre-shared-key
+* @Parameter: challenge []byte, the challenge
+* @Return: []byte, the HMAC-SHA256 signature
+**********************************************************************/
+func authSign(secret string, challenge []byte) ([]byte) {
+    mac := hmac.New(sha256.New, []byte(secret))
+    mac.Write(challenge)
+    return mac.Sum(nil)
+}
@@ -0,0 +1,44 @@
+// +build !windows
+
+/**
+* Filename: backlog_unix.go
+* Description: the listen backlog of unix
+* Author: knownsec404
+* Time: 2020.10.23
+*/
+
+package forward
+
+import (
+    "errors"
+    "net"
+    "syscall"
+)
+
+
+/**********************************************************************
+* @Function: setBacklog(serv net.Listener, backlog int) (error)
+* @Description: change the backlog of listening socket, "listen()" on the
+*   listening socket again updates its backlog
+* @Parameter: serv net.Listener, the tcp or unix listener
+* @Parameter: backlog int, the backlog
+* @Return: error, the error
+**********************************************************************/
+func setBacklog(serv net.Listener, backlog int) (error) {
+    s, ok := serv.(syscall.Conn)
+    if !ok {
+        return errors.New("backlog not supported")
+    }
+    raw, err := s.SyscallConn()
+    if err != nil {
+        return err
+    }
+    var lerr error
+    err = raw.Control(func(fd uintptr) {
+        lerr = syscall.Listen(int(fd), backlog)
+    })
+    if err != nil {
+        return err
+    }
+    return lerr
+}
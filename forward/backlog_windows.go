@@ -0,0 +1,25 @@
+/**
+* Filename: backlog_windows.go
+* Description: the listen backlog of windows, the backlog of listening
+*   socket can not be changed, it is ignored
+* Author: knownsec404
+* Time: 2020.10.23
+*/
+
+package forward
+
+import (
+    "net"
+)
+
+
+/**********************************************************************
+* @Function: setBacklog(serv net.Listener, backlog int) (error)
+* @Description: the backlog is ignored on windows
+* @Parameter: serv net.Listener, the tcp or unix listener
+* @Parameter: backlog int, the backlog
+* @Return: error, always nil
+**********************************************************************/
+func setBacklog(serv net.Listener, backlog int) (error) {
+    return nil
+}
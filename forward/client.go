@@ -0,0 +1,265 @@
+/**
+* Filename: client.go
+* Description: the PortForward admin client, it talks to the admin API of
+*   a running PortForward process on unix socket or loopback address.
+* Author: knownsec404
+* Time: 2020.10.23
+*/
+
+package forward
+
+import (
+    "bytes"
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "net"
+    "net/http"
+    "net/url"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// the client of admin API
+type AdminClient struct {
+    client      *http.Client
+    // the base url of requests
+    base        string
+    // the token of admin API, empty if it is not required
+    token       string
+}
+
+
+/**********************************************************************
+* @Function: NewAdminClient(address string) (*AdminClient)
+* @Description: create the client of admin API
+* @Parameter: address string, the address of admin API, "unix:/path/to/sock"
+*   or "ip:port"
+* @Return: *AdminClient, the admin client
+**********************************************************************/
+func NewAdminClient(address string) (*AdminClient) {
+    // there is no request timeout, since removing or pausing a rule waits
+    // for its links to drain within the grace period
+    dialer := &net.Dialer{Timeout: 10 * time.Second}
+    transport := &http.Transport{DialContext: dialer.DialContext}
+    base := "http://" + address
+    if strings.HasPrefix(address, "unix:") {
+        path := strings.TrimPrefix(address, "unix:")
+        transport.DialContext = func(ctx context.Context, network string,
+            addr string) (net.Conn, error) {
+            return dialer.DialContext(ctx, "unix", path)
+        }
+        base = "http://localhost"
+    }
+    return &AdminClient{
+        client: &http.Client{Transport: transport},
+        base:   base,
+    }
+}
+
+
+/**********************************************************************
+* @Function: (this *AdminClient) SetToken(token string)
+* @Description: set the token of admin API, see "LoadAdminToken()"
+* @Parameter: token string, the token
+* @Return: nil
+**********************************************************************/
+func (this *AdminClient) SetToken(token string) {
+    this.token = token
+}
+
+
+/**********************************************************************
+* @Function: (this *AdminClient) do(method string, path string,
+*   body interface{}, result interface{}) (error)
+* @Description: send the request to admin API and decode the response
+* @Parameter: method string, the http method
+* @Parameter: path string, the escaped path
+* @Parameter: body interface{}, the request body, nil if no body
+* @Parameter: result interface{}, decode the response into it, nil if the
+*   response is ignored
+* @Return: error, the error
+**********************************************************************/
+func (this *AdminClient) do(method string, path string, body interface{},
+    result interface{}) (error) {
+    var reader io.Reader
+    if body != nil {
+        data, err := json.Marshal(body)
+        if err != nil {
+            return err
+        }
+        reader = bytes.NewReader(data)
+    }
+    req, err := http.NewRequest(method, this.base + path, reader)
+    if err != nil {
+        return err
+    }
+    req.Header.Set("Content-Type", "application/json")
+    if this.token != "" {
+        req.Header.Set("Authorization", "Bearer " + this.token)
+    }
+    resp, err := this.client.Do(req)
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+
+    if resp.StatusCode != http.StatusOK {
+        var e adminError
+        if json.NewDecoder(resp.Body).Decode(&e) != nil || e.Error == "" {
+            return fmt.Errorf("admin API error, %s", resp.Status)
+        }
+        return errors.New(e.Error)
+    }
+    if result == nil {
+        return nil
+    }
+    return json.NewDecoder(resp.Body).Decode(result)
+}
+
+
+/**********************************************************************
+* @Function: rulePath(name string, items ...string) (string)
+* @Description: get the escaped path of rule
+* @Parameter: name string, the rule name
+* @Parameter: items ...string, the path items after rule name
+* @Return: string, the escaped path
+**********************************************************************/
+func rulePath(name string, items ...string) (string) {
+    path := "/rules/" + url.PathEscape(name)
+    for _, item := range items {
+        path += "/" + url.PathEscape(item)
+    }
+    return path
+}
+
+
+/**********************************************************************
+* @Function: (this *AdminClient) Rules() ([]RuleStatus, error)
+* @Description: list rules
+* @Parameter: nil
+* @Return: ([]RuleStatus, error), the status of rules and error
+**********************************************************************/
+func (this *AdminClient) Rules() ([]RuleStatus, error) {
+    var rules []RuleStatus
+    err := this.do(http.MethodGet, "/rules", nil, &rules)
+    return rules, err
+}
+
+
+/**********************************************************************
+* @Function: (this *AdminClient) Add(rule RuleConfig) (RuleStatus, error)
+* @Description: add rule
+* @Parameter: rule RuleConfig, the rule of configuration file
+* @Return: (RuleStatus, error), the status of rule and error
+**********************************************************************/
+func (this *AdminClient) Add(rule RuleConfig) (RuleStatus, error) {
+    var status RuleStatus
+    err := this.do(http.MethodPost, "/rules", rule, &status)
+    return status, err
+}
+
+
+/**********************************************************************
+* @Function: (this *AdminClient) Remove(name string) (error)
+* @Description: remove rule
+* @Parameter: name string, the rule name
+* @Return: error, the error
+**********************************************************************/
+func (this *AdminClient) Remove(name string) (error) {
+    return this.do(http.MethodDelete, rulePath(name), nil, nil)
+}
+
+
+/**********************************************************************
+* @Function: (this *AdminClient) Pause(name string) (RuleStatus, error)
+* @Description: pause rule
+* @Parameter: name string, the rule name
+* @Return: (RuleStatus, error), the status of rule and error
+**********************************************************************/
+func (this *AdminClient) Pause(name string) (RuleStatus, error) {
+    var status RuleStatus
+    err := this.do(http.MethodPost, rulePath(name, "pause"), nil, &status)
+    return status, err
+}
+
+
+/**********************************************************************
+* @Function: (this *AdminClient) Resume(name string) (RuleStatus, error)
+* @Description: resume rule
+* @Parameter: name string, the rule name
+* @Return: (RuleStatus, error), the status of rule and error
+**********************************************************************/
+func (this *AdminClient) Resume(name string) (RuleStatus, error) {
+    var status RuleStatus
+    err := this.do(http.MethodPost, rulePath(name, "resume"), nil, &status)
+    return status, err
+}
+
+
+/**********************************************************************
+* @Function: (this *AdminClient) Links(name string) ([]LinkStatus, error)
+* @Description: list the active links of rule
+* @Parameter: name string, the rule name
+* @Return: ([]LinkStatus, error), the active links and error
+**********************************************************************/
+func (this *AdminClient) Links(name string) ([]LinkStatus, error) {
+    var links []LinkStatus
+    err := this.do(http.MethodGet, rulePath(name, "links"), nil, &links)
+    return links, err
+}
+
+
+/**********************************************************************
+* @Function: (this *AdminClient) AllLinks() ([]LinkStatus, error)
+* @Description: list the active links of all rules
+* @Parameter: nil
+* @Return: ([]LinkStatus, error), the active links and error
+**********************************************************************/
+func (this *AdminClient) AllLinks() ([]LinkStatus, error) {
+    var links []LinkStatus
+    err := this.do(http.MethodGet, "/links", nil, &links)
+    return links, err
+}
+
+
+/**********************************************************************
+* @Function: (this *AdminClient) CloseLink(name string, id int) (error)
+* @Description: close the active link of rule
+* @Parameter: name string, the rule name
+* @Parameter: id int, the link id
+* @Return: error, the error
+**********************************************************************/
+func (this *AdminClient) CloseLink(name string, id int) (error) {
+    path := rulePath(name, "links", strconv.Itoa(id))
+    return this.do(http.MethodDelete, path, nil, nil)
+}
+
+
+/**********************************************************************
+* @Function: (this *AdminClient) LogLevel() (string, error)
+* @Description: get the log level
+* @Parameter: nil
+* @Return: (string, error), the log level name and error
+**********************************************************************/
+func (this *AdminClient) LogLevel() (string, error) {
+    var level adminLog
+    err := this.do(http.MethodGet, "/log", nil, &level)
+    return level.Level, err
+}
+
+
+/**********************************************************************
+* @Function: (this *AdminClient) SetLogLevel(name string) (string, error)
+* @Description: set the log level
+* @Parameter: name string, the log level name, such as "debug"
+* @Return: (string, error), the log level name and error
+**********************************************************************/
+func (this *AdminClient) SetLogLevel(name string) (string, error) {
+    var level adminLog
+    err := this.do(http.MethodPut, "/log", adminLog{Level: name}, &level)
+    return level.Level, err
+}
@@ -0,0 +1,394 @@
+/**
+* Filename: config.go
+* Description: the PortForward rule configuration file, one process can run
+*   multiple forwarding rules at the same time. The configuration file is a
+*   json document, for example:
+*   {
+*       "rules": [
+*           {
+*               "name":  "rdp",
+*               "proto": "tcp",
+*               "sock1": "tls-listen:0.0.0.0:8443",
+*               "sock2": "conn:192.168.1.10:3389",
+*               "tls1":  {"cert": "server.pem", "key": "server.key"}
+*           }
+*       ]
+*   }
+* Author: knownsec404
+* Time: 2020.10.22
+*/
+
+package forward
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io/ioutil"
+    "strings"
+    "time"
+)
+
+// the single forwarding rule in configuration file
+type RuleConfig struct {
+    Name        string  `json:"name"`
+    // the log level of rule, it overrides the global one
+    LogLevel    string  `json:"log_level"`
+    Proto       string  `json:"proto"`
+    Sock1       string  `json:"sock1"`
+    Sock2       string  `json:"sock2"`
+    // the TLS options of tls-listen/tls-conn sock
+    TLS1        TLSOptions  `json:"tls1"`
+    TLS2        TLSOptions  `json:"tls2"`
+    // the pre-shared-key of sock authentication
+    Auth1       string      `json:"auth1"`
+    Auth2       string      `json:"auth2"`
+    // the pre-shared-key of sock encryption
+    Crypt1      string      `json:"crypt1"`
+    Crypt2      string      `json:"crypt2"`
+    // the upstream proxy chain of conn sock, such as "socks5://host:port"
+    Upstream1   []string    `json:"upstream1"`
+    Upstream2   []string    `json:"upstream2"`
+    // multiplex the links over one long-lived connection
+    Mux1        bool        `json:"mux1"`
+    Mux2        bool        `json:"mux2"`
+    // the connection pool size of conn<=>conn and listen<=>listen mode
+    Pool        int         `json:"pool"`
+    // the username/password of socks5/http-proxy sock
+    ProxyAuth   ProxyAuth   `json:"proxy_auth"`
+    // the retry policy of dial failures
+    Retry       RetryConfig `json:"retry"`
+    // the timeout settings, it overrides the global ones
+    Timeouts    TimeoutsConfig  `json:"timeouts"`
+}
+
+// the retry policy in configuration file
+type RetryConfig struct {
+    Initial     Duration    `json:"initial"`
+    Max         Duration    `json:"max"`
+    Multiplier  float64     `json:"multiplier"`
+    Jitter      float64     `json:"jitter"`
+    MaxAttempts int         `json:"max_attempts"`
+    DialRetries int         `json:"dial_retries"`
+}
+
+// the timeout settings in configuration file
+type TimeoutsConfig struct {
+    Dial        Duration    `json:"dial"`
+    Idle        Duration    `json:"idle"`
+    Lifetime    Duration    `json:"lifetime"`
+    Linger      Duration    `json:"linger"`
+    Keepalive   Duration    `json:"keepalive"`
+    Pairing     Duration    `json:"pairing"`
+    UDPIdle     Duration    `json:"udp_idle"`
+    UDPConnIdle Duration    `json:"udp_conn_idle"`
+    AcceptPoll  Duration    `json:"accept_poll"`
+}
+
+// the duration in configuration file, such as "500ms", "1m30s"
+type Duration time.Duration
+
+// the PortForward configuration file
+type Config struct {
+    // the timeout settings of all rules
+    Timeouts    TimeoutsConfig  `json:"timeouts"`
+    Rules       []RuleConfig    `json:"rules"`
+}
+
+
+/**********************************************************************
+* @Function: LoadConfig(filename string) ([]Args, error)
+* @Description: read configuration file and convert each rule to launch
+*   arguments, all of the rules are checked before return, so that an
+*   invalid rule can be reported up-front
+* @Parameter: filename string, the configuration file path
+* @Return: ([]Args, error), the launch arguments of rules and error
+**********************************************************************/
+func LoadConfig(filename string) ([]Args, error) {
+    data, err := ioutil.ReadFile(filename)
+    if err != nil {
+        return nil, err
+    }
+
+    var config Config
+    err = json.Unmarshal(data, &config)
+    if err != nil {
+        return nil, fmt.Errorf("parse config [%s] error, %s", filename, err)
+    }
+    if len(config.Rules) == 0 {
+        return nil, fmt.Errorf("no rule found in config [%s]", filename)
+    }
+
+    names := make(map[string]bool)
+    rules := make([]Args, 0, len(config.Rules))
+    for i, rule := range config.Rules {
+        // the rule name is used in log lines, generate one if not given
+        if rule.Name == "" {
+            rule.Name = fmt.Sprintf("rule%d", i + 1)
+        }
+        if names[rule.Name] {
+            return nil, fmt.Errorf("rule [%s]: name: duplicate rule name",
+                                   rule.Name)
+        }
+        names[rule.Name] = true
+
+        args, err := parseRule(rule)
+        if err != nil {
+            return nil, err
+        }
+        args.Timeouts = args.Timeouts.merge(config.Timeouts.timeouts())
+        rules = append(rules, args)
+    }
+
+    return rules, nil
+}
+
+
+/**********************************************************************
+* @Function: parseRule(rule RuleConfig) (Args, error)
+* @Description: parse and check a rule, convert it to launch arguments
+* @Parameter: rule RuleConfig, the rule from configuration file
+* @Return: (Args, error), the launch arguments and error
+**********************************************************************/
+func parseRule(rule RuleConfig) (Args, error) {
+    e1, err := ParseEndpoint(rule.Sock1)
+    if err != nil {
+        return Args{}, fmt.Errorf("rule [%s]: sock1: %s", rule.Name, err)
+    }
+    e2, err := ParseEndpoint(rule.Sock2)
+    if err != nil {
+        return Args{}, fmt.Errorf("rule [%s]: sock2: %s", rule.Name, err)
+    }
+    protocol, err := RuleProto(rule.Proto, e1, e2)
+    if err != nil {
+        return Args{}, fmt.Errorf("rule [%s]: proto: %s", rule.Name, err)
+    }
+
+    if rule.LogLevel != "" {
+        _, err = ParseLogLevel(rule.LogLevel)
+        if err != nil {
+            return Args{}, fmt.Errorf("rule [%s]: log_level: %s", rule.Name, err)
+        }
+    }
+
+    args := Args{
+        Name:       rule.Name,
+        LogLevel:   rule.LogLevel,
+        Protocol:   protocol,
+        Proto1:     e1.Protocol,
+        Method1:    e1.Method,
+        Addr1:      e1.Address,
+        Options1:   e1.Options,
+        TLS1:       rule.TLS1,
+        Auth1:      rule.Auth1,
+        Crypt1:     rule.Crypt1,
+        Upstream1:  rule.Upstream1,
+        Mux1:       rule.Mux1,
+        Proto2:     e2.Protocol,
+        Method2:    e2.Method,
+        Addr2:      e2.Address,
+        Options2:   e2.Options,
+        TLS2:       rule.TLS2,
+        Auth2:      rule.Auth2,
+        Crypt2:     rule.Crypt2,
+        Upstream2:  rule.Upstream2,
+        Mux2:       rule.Mux2,
+        Pool:       rule.Pool,
+        ProxyAuth:  rule.ProxyAuth,
+        Retry:      RetryPolicy{
+            Initial:        time.Duration(rule.Retry.Initial),
+            Max:            time.Duration(rule.Retry.Max),
+            Multiplier:     rule.Retry.Multiplier,
+            Jitter:         rule.Retry.Jitter,
+            MaxAttempts:    rule.Retry.MaxAttempts,
+            DialRetries:    rule.Retry.DialRetries,
+        },
+        Timeouts:   rule.Timeouts.timeouts(),
+    }
+    err = CheckArgs(args)
+    if err != nil {
+        return Args{}, fmt.Errorf("rule [%s]: %s", rule.Name, err)
+    }
+    return args, nil
+}
+
+
+/**********************************************************************
+* @Function: (this TimeoutsConfig) timeouts() (Timeouts)
+* @Description: convert to the timeout settings
+* @Parameter: nil
+* @Return: Timeouts, the timeout settings
+**********************************************************************/
+func (this TimeoutsConfig) timeouts() (Timeouts) {
+    return Timeouts{
+        Dial:        time.Duration(this.Dial),
+        Idle:        time.Duration(this.Idle),
+        Lifetime:    time.Duration(this.Lifetime),
+        Linger:      time.Duration(this.Linger),
+        Keepalive:   time.Duration(this.Keepalive),
+        Pairing:     time.Duration(this.Pairing),
+        UDPIdle:     time.Duration(this.UDPIdle),
+        UDPConnIdle: time.Duration(this.UDPConnIdle),
+        AcceptPoll:  time.Duration(this.AcceptPoll),
+    }
+}
+
+
+/**********************************************************************
+* @Function: (this *Duration) UnmarshalJSON(data []byte) (error)
+* @Description: parse the duration string, such as "500ms", "1m30s"
+* @Parameter: data []byte, the json value
+* @Return: error, the error
+**********************************************************************/
+func (this *Duration) UnmarshalJSON(data []byte) (error) {
+    var str string
+    err := json.Unmarshal(data, &str)
+    if err != nil {
+        return fmt.Errorf("invalid duration %s", data)
+    }
+    d, err := time.ParseDuration(str)
+    if err != nil {
+        return err
+    }
+    *this = Duration(d)
+    return nil
+}
+
+
+/**********************************************************************
+* @Function: (this Duration) MarshalJSON() ([]byte, error)
+* @Description: format the duration as string, such as "1m30s"
+* @Parameter: nil
+* @Return: ([]byte, error), the json value and error
+**********************************************************************/
+func (this Duration) MarshalJSON() ([]byte, error) {
+    return json.Marshal(time.Duration(this).String())
+}
+
+
+/**********************************************************************
+* @Function: ParseProto(proto string) (uint8, error)
+* @Description: parse and check protocol string
+* @Parameter: proto string, the protocol string (tcp/udp/unix)
+* @Return: (uint8, error), the protocol and error
+**********************************************************************/
+func ParseProto(proto string) (uint8, error) {
+    if strings.ToUpper(proto) == "TCP" {
+        return PORTFORWARD_PROTO_TCP, nil
+    } else if strings.ToUpper(proto) == "UDP" {
+        return PORTFORWARD_PROTO_UDP, nil
+    } else if strings.ToUpper(proto) == "UNIX" {
+        return PORTFORWARD_PROTO_UNIX, nil
+    } else {
+        errmsg := fmt.Sprintf("unknown protocol [%s]", proto)
+        return PORTFORWARD_PROTO_NIL, errors.New(errmsg)
+    }
+}
+
+
+/**********************************************************************
+* @Function: ParseSock(sock string) (uint8, string, error)
+* @Description: parse and check sock string, the sock URI with protocol or
+*   options is refused, use "ParseEndpoint()" for it
+* @Parameter: sock string, the sock string from command-line
+* @Return: (uint8, string, error), the method, address and error
+**********************************************************************/
+func ParseSock(sock string) (uint8, string, error) {
+    endpoint, err := ParseEndpoint(sock)
+    if err != nil {
+        return PORTFORWARD_SOCK_NIL, "", err
+    }
+    if endpoint.Protocol != PORTFORWARD_PROTO_NIL ||
+       endpoint.Options != (SockOptions{}) {
+        return PORTFORWARD_SOCK_NIL, "",
+               errors.New("sock with protocol or options requires ParseEndpoint")
+    }
+    return endpoint.Method, endpoint.Address, nil
+}
+
+
+/**********************************************************************
+* @Function: RuleProto(proto string, sock1 Endpoint, sock2 Endpoint) (uint8,
+*   error)
+* @Description: get the protocol of rule, it can be omitted if both of the
+*   socks have their own protocols, then it is the protocol of sock1
+* @Parameter: proto string, the protocol string, empty if it is omitted
+* @Parameter: sock1 Endpoint, the endpoint of sock1
+* @Parameter: sock2 Endpoint, the endpoint of sock2
+* @Return: (uint8, error), the protocol and error
+**********************************************************************/
+func RuleProto(proto string, sock1 Endpoint, sock2 Endpoint) (uint8, error) {
+    if proto != "" {
+        return ParseProto(proto)
+    }
+    if sock1.Protocol == PORTFORWARD_PROTO_NIL ||
+       sock2.Protocol == PORTFORWARD_PROTO_NIL {
+        return PORTFORWARD_PROTO_NIL,
+               errors.New("protocol is required unless both socks have it")
+    }
+    return sock1.Protocol, nil
+}
+
+
+/**********************************************************************
+* @Function: FormatProto(protocol uint8) (string)
+* @Description: format protocol as the string of command-line
+* @Parameter: protocol uint8, the protocol
+* @Return: string, the protocol string
+**********************************************************************/
+func FormatProto(protocol uint8) (string) {
+    if protocol == PORTFORWARD_PROTO_UDP {
+        return "udp"
+    } else if protocol == PORTFORWARD_PROTO_UNIX {
+        return "unix"
+    }
+    return "tcp"
+}
+
+
+/**********************************************************************
+* @Function: FormatSock(method uint8, address string) (string)
+* @Description: format method and address as the sock string of
+*   command-line, it is the reverse of "ParseSock()"
+* @Parameter: method uint8, the sock method
+* @Parameter: address string, the address
+* @Return: string, the sock string
+**********************************************************************/
+func FormatSock(method uint8, address string) (string) {
+    name := ""
+    switch method &^ PORTFORWARD_SOCK_TLS {
+    case PORTFORWARD_SOCK_SOCKS5:
+        return "socks5:"
+    case PORTFORWARD_SOCK_HTTP:
+        return "http-proxy:"
+    case PORTFORWARD_SOCK_LISTEN:
+        name = "listen"
+    case PORTFORWARD_SOCK_CONN:
+        name = "conn"
+    }
+    if method & PORTFORWARD_SOCK_TLS != 0 {
+        name = "tls-" + name
+    }
+    return name + ":" + address
+}
+
+
+/**********************************************************************
+* @Function: CheckArgs(args Args) (error)
+* @Description: check whether the socks can be launched with the options,
+*   the TLS certificates are loaded here, so that the error can be reported
+*   before launch
+* @Parameter: args Args, the launch arguments
+* @Return: error, the error with sock field
+**********************************************************************/
+func CheckArgs(args Args) (error) {
+    _, _, err := sockFunc(args, 1, StdLogger{})
+    if err != nil {
+        return fmt.Errorf("sock1: %s", err)
+    }
+    _, _, err = sockFunc(args, 2, StdLogger{})
+    if err != nil {
+        return fmt.Errorf("sock2: %s", err)
+    }
+    return nil
+}
@@ -0,0 +1,325 @@
+/**
+* Filename: crypt.go
+* Description: the PortForward symmetric encryption layer, it is enabled on
+*   one side of a rule, so that two cooperating PortForward instances can
+*   encrypt the middle hop while the outer ends remain plain.
+*   each side sends 32 bytes random salt at first, the key of each direction
+*   is HMAC-SHA256(secret, "PFC1" + salt of sender + salt of receiver), so
+*   that a recorded stream can not be replayed to another connection, then
+*   the data is sent by frames: 2 bytes length (big endian) + AES-256-GCM
+*   sealed data, the nonce is the frame counter of the direction.
+* Author: knownsec404
+* Time: 2020.10.22
+*/
+
+package forward
+
+import (
+    "bytes"
+    "context"
+    "crypto/aes"
+    "crypto/cipher"
+    "crypto/hmac"
+    "crypto/rand"
+    "crypto/sha256"
+    "encoding/binary"
+    "errors"
+    "io"
+    "sync"
+    "time"
+)
+
+const cryptMagic string = "PFC1"
+const cryptSaltSize int = 32
+// the maximum plaintext size of frame
+const cryptFrameSize int = 16 * 1024
+// the timeout of salt exchange, it is a variable for tests
+var cryptTimeout time.Duration = 10 * time.Second
+
+// the encrypted connection
+type CryptConn struct {
+    Conn
+    secret      string
+    salt        []byte
+    // the keys of both directions are derived once the salt of peer is
+    // received, by the first "Read" or "Write"
+    exchange    sync.Once
+    exerr       error
+    // the deadline set by "SetDeadline()", it is restored after the salt
+    // of peer is received
+    dmutex      sync.Mutex
+    deadline    time.Time
+    // the read direction
+    rmutex      sync.Mutex
+    raead       cipher.AEAD
+    rnonce      uint64
+    rbuf        []byte
+    // the write direction
+    wmutex      sync.Mutex
+    waead       cipher.AEAD
+    wnonce      uint64
+}
+
+
+/**********************************************************************
+* @Function: NewCryptConn(conn Conn, secret string) (*CryptConn, error)
+* @Description: initialize CryptConn structure, and send the salt to peer,
+*   the salt of peer is received on the first "Read" or "Write"
+* @Parameter: conn Conn, the underlying connection
+* @Parameter: secret string, the pre-shared-key
+* @Return: (*CryptConn, error), the new CryptConn structure pointer and error
+**********************************************************************/
+func NewCryptConn(conn Conn, secret string) (*CryptConn, error) {
+    salt := make([]byte, cryptSaltSize)
+    _, err := rand.Read(salt)
+    if err != nil {
+        return nil, err
+    }
+    setDeadline(conn, time.Now().Add(cryptTimeout))
+    _, err = conn.Write(salt)
+    setDeadline(conn, time.Time{})
+    if err != nil {
+        return nil, err
+    }
+
+    return &CryptConn{
+        Conn:   conn,
+        secret: secret,
+        salt:   salt,
+    }, nil
+}
+
+
+/**********************************************************************
+* @Function: (this *CryptConn) keyExchange() (error)
+* @Description: receive the salt of peer, and derive the keys of both
+*   directions from the salts of both sides, it is done only once
+* @Parameter: nil
+* @Return: error, the error of key exchange
+**********************************************************************/
+func (this *CryptConn) keyExchange() (error) {
+    this.exchange.Do(func() {
+        // the salt must be received in time, unless the deadline set by
+        // "SetDeadline()" is earlier
+        deadline := time.Now().Add(cryptTimeout)
+        this.dmutex.Lock()
+        if !this.deadline.IsZero() && this.deadline.Before(deadline) {
+            deadline = this.deadline
+        }
+        setDeadline(this.Conn, deadline)
+        this.dmutex.Unlock()
+
+        salt := make([]byte, cryptSaltSize)
+        _, err := io.ReadFull(this.Conn, salt)
+        this.dmutex.Lock()
+        setDeadline(this.Conn, this.deadline)
+        this.dmutex.Unlock()
+        if err != nil {
+            this.exerr = err
+            return
+        }
+        // reject the reflected salt
+        if bytes.Equal(salt, this.salt) {
+            this.exerr = errors.New("crypt salt is reflected")
+            return
+        }
+        this.raead, err = cryptAEAD(this.secret, salt, this.salt)
+        if err != nil {
+            this.exerr = err
+            return
+        }
+        this.waead, this.exerr = cryptAEAD(this.secret, this.salt, salt)
+    })
+    return this.exerr
+}
+
+
+/**********************************************************************
+* @Function: (this *CryptConn) Read(b []byte) (n int, err error)
+* @Description: read and decrypt data from connection
+* @Parameter: b []byte, the buffer for receive data
+* @Return: (n int, err error), the length of the data read and error
+**********************************************************************/
+func (this *CryptConn) Read(b []byte) (n int, err error) {
+    err = this.keyExchange()
+    if err != nil {
+        return 0, err
+    }
+    this.rmutex.Lock()
+    defer this.rmutex.Unlock()
+
+    // read the next frame
+    if len(this.rbuf) == 0 {
+        header := make([]byte, 2)
+        _, err := io.ReadFull(this.Conn, header)
+        if err != nil {
+            return 0, err
+        }
+        frame := make([]byte, binary.BigEndian.Uint16(header))
+        _, err = io.ReadFull(this.Conn, frame)
+        if err != nil {
+            return 0, err
+        }
+        this.rbuf, err = this.raead.Open(frame[:0],
+                                         cryptNonce(this.raead, this.rnonce),
+                                         frame, header)
+        if err != nil {
+            return 0, errors.New("crypt frame authentication failed")
+        }
+        this.rnonce += 1
+    }
+
+    n = copy(b, this.rbuf)
+    this.rbuf = this.rbuf[n:]
+    return n, nil
+}
+
+
+/**********************************************************************
+* @Function: (this *CryptConn) Write(b []byte) (n int, err error)
+* @Description: encrypt and write data to connection
+* @Parameter: b []byte, the data to be sent
+* @Return: (n int, err error), the length of the data write and error
+**********************************************************************/
+func (this *CryptConn) Write(b []byte) (n int, err error) {
+    err = this.keyExchange()
+    if err != nil {
+        return 0, err
+    }
+    this.wmutex.Lock()
+    defer this.wmutex.Unlock()
+
+    for n < len(b) {
+        size := len(b) - n
+        if size > cryptFrameSize {
+            size = cryptFrameSize
+        }
+        header := make([]byte, 2)
+        binary.BigEndian.PutUint16(header,
+                                   uint16(size + this.waead.Overhead()))
+        frame := make([]byte, 2, 2 + size + this.waead.Overhead())
+        copy(frame, header)
+        frame = this.waead.Seal(frame, cryptNonce(this.waead, this.wnonce),
+                                b[n:n + size], header)
+        this.wnonce += 1
+        _, err = this.Conn.Write(frame)
+        if err != nil {
+            return n, err
+        }
+        n += size
+    }
+    return n, nil
+}
+
+
+/**********************************************************************
+* @Function: (this *CryptConn) SetDeadline(t time.Time) (error)
+* @Description: set the deadline of underlying connection
+* @Parameter: t time.Time, the deadline
+* @Return: error, always nil
+**********************************************************************/
+func (this *CryptConn) SetDeadline(t time.Time) (error) {
+    this.dmutex.Lock()
+    defer this.dmutex.Unlock()
+    this.deadline = t
+    setDeadline(this.Conn, t)
+    return nil
+}
+
+
+/**********************************************************************
+* @Function: (this *CryptConn) CloseWrite() (error)
+* @Description: shut down the writing side of underlying connection after
+*   the frame being written is finished
+* @Parameter: nil
+* @Return: error, the error
+**********************************************************************/
+func (this *CryptConn) CloseWrite() (error) {
+    this.wmutex.Lock()
+    defer this.wmutex.Unlock()
+    return closeWrite(this.Conn)
+}
+
+
+/**********************************************************************
+* @Function: ListenCrypt(listen ListenFunc, secret string) (ListenFunc)
+* @Description: wrap the listen function, the accepted socket is returned
+*   as encrypted connection
+* @Parameter: listen ListenFunc, the underlying listen function
+* @Parameter: secret string, the pre-shared-key
+* @Return: ListenFunc, the listen function with encryption
+**********************************************************************/
+func ListenCrypt(listen ListenFunc, secret string) (ListenFunc) {
+    handshake := func(conn Conn) (Conn, error) {
+        cconn, err := NewCryptConn(conn, secret)
+        if err != nil {
+            return nil, err
+        }
+        return cconn, nil
+    }
+    return func(ctx context.Context, address string, clientc chan Conn,
+        logger Logger) {
+        ListenHandshake(ctx, address, clientc, logger, listen, handshake)
+    }
+}
+
+
+/**********************************************************************
+* @Function: ConnCrypt(dial DialFunc, secret string) (DialFunc)
+* @Description: wrap the dial function, the dialed socket is returned as
+*   encrypted connection
+* @Parameter: dial DialFunc, the underlying dial function
+* @Parameter: secret string, the pre-shared-key
+* @Return: DialFunc, the dial function with encryption
+**********************************************************************/
+func ConnCrypt(dial DialFunc, secret string) (DialFunc) {
+    return func(address string) (Conn, error) {
+        conn, err := dial(address)
+        if err != nil {
+            return nil, err
+        }
+        cconn, err := NewCryptConn(conn, secret)
+        if err != nil {
+            conn.Close()
+            return nil, err
+        }
+        return cconn, nil
+    }
+}
+
+
+/**********************************************************************
+* @Function: cryptAEAD(secret string, sender []byte, receiver []byte)
+*   (cipher.AEAD, error)
+* @Description: derive the key of direction and create AES-256-GCM
+* @Parameter: secret string, the pre-shared-key
+* @Parameter: sender []byte, the salt of sender
+* @Parameter: receiver []byte, the salt of receiver
+* @Return: (cipher.AEAD, error), the AEAD and error
+**********************************************************************/
+func cryptAEAD(secret string, sender []byte, receiver []byte) (cipher.AEAD,
+    error) {
+    mac := hmac.New(sha256.New, []byte(secret))
+    mac.Write([]byte(cryptMagic))
+    mac.Write(sender)
+    mac.Write(receiver)
+    block, err := aes.NewCipher(mac.Sum(nil))
+    if err != nil {
+        return nil, err
+    }
+    return cipher.NewGCM(block)
+}
+
+
+/**********************************************************************
+* @Function: cryptNonce(aead cipher.AEAD, counter uint64) ([]byte)
+* @Description: build the nonce by frame counter
+* @Parameter: aead cipher.AEAD, the AEAD
+* @Parameter: counter uint64, the frame counter
+* @Return: []byte, the nonce
+**********************************************************************/
+func cryptNonce(aead cipher.AEAD, counter uint64) ([]byte) {
+    nonce := make([]byte, aead.NonceSize())
+    binary.BigEndian.PutUint64(nonce[len(nonce) - 8:], counter)
+    return nonce
+}
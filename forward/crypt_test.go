@@ -0,0 +1,175 @@
+/**
+* Filename: crypt_test.go
+* Description: the unit tests of symmetric encryption layer
+* Author: knownsec404
+* Time: 2020.10.23
+*/
+
+package forward
+
+import (
+    "bytes"
+    "io"
+    "io/ioutil"
+    "net"
+    "testing"
+    "time"
+)
+
+// the connection which records the written data
+type recordConn struct {
+    net.Conn
+    written     bytes.Buffer
+}
+
+func (this *recordConn) Write(b []byte) (int, error) {
+    this.written.Write(b)
+    return this.Conn.Write(b)
+}
+
+
+/**********************************************************************
+* @Function: cryptPair(t *testing.T, ln net.Listener,
+*   client func(conn net.Conn)) (*CryptConn)
+* @Description: accept a connection of "ln" as the encrypted listen side,
+*   while "client" writes to the dialed connection concurrently
+* @Parameter: t *testing.T, the test
+* @Parameter: ln net.Listener, the listener
+* @Parameter: client func(conn net.Conn), the client of dialed connection
+* @Return: *CryptConn, the encrypted connection of listen side
+**********************************************************************/
+func cryptPair(t *testing.T, ln net.Listener,
+    client func(conn net.Conn)) (*CryptConn) {
+    go func() {
+        conn, err := net.Dial("tcp", ln.Addr().String())
+        if err != nil {
+            t.Errorf("dial error, %s", err)
+            return
+        }
+        client(conn)
+    }()
+    conn, err := ln.Accept()
+    if err != nil {
+        t.Fatalf("accept error, %s", err)
+    }
+    t.Cleanup(func() { conn.Close() })
+    conn.SetDeadline(time.Now().Add(5 * time.Second))
+    cconn, err := NewCryptConn(conn, "secret")
+    if err != nil {
+        t.Fatalf("NewCryptConn error, %s", err)
+    }
+    return cconn
+}
+
+
+func TestCryptReplay(t *testing.T) {
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer ln.Close()
+
+    // record the stream of client to listen side
+    recorded := make(chan []byte, 1)
+    server := cryptPair(t, ln, func(conn net.Conn) {
+        defer conn.Close()
+        record := &recordConn{Conn: conn}
+        cconn, err := NewCryptConn(record, "secret")
+        if err != nil {
+            t.Errorf("NewCryptConn error, %s", err)
+            recorded <- nil
+            return
+        }
+        cconn.Write([]byte("hello"))
+        // wait until the listen side closed
+        io.Copy(ioutil.Discard, cconn)
+        recorded <- record.written.Bytes()
+    })
+    buf := make([]byte, 16)
+    n, err := server.Read(buf)
+    if err != nil || string(buf[:n]) != "hello" {
+        t.Fatalf("Read = %q, %v, want \"hello\"", buf[:n], err)
+    }
+    server.Close()
+    stream := <-recorded
+    if len(stream) == 0 {
+        t.Fatal("no stream is recorded")
+    }
+
+    // replay the recorded stream to the listen side
+    server = cryptPair(t, ln, func(conn net.Conn) {
+        defer conn.Close()
+        conn.Write(stream)
+        io.Copy(ioutil.Discard, conn)
+    })
+    n, err = server.Read(buf)
+    if err == nil {
+        t.Fatalf("replayed stream is accepted, Read = %q", buf[:n])
+    }
+    server.Close()
+}
+
+
+func TestCryptExchangeTimeout(t *testing.T) {
+    timeout := cryptTimeout
+    cryptTimeout = 200 * time.Millisecond
+    defer func() { cryptTimeout = timeout }()
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer ln.Close()
+
+    // the client never sends the salt
+    closed := make(chan bool)
+    defer close(closed)
+    server := cryptPair(t, ln, func(conn net.Conn) {
+        defer conn.Close()
+        <-closed
+    })
+    start := time.Now()
+    _, err = server.Read(make([]byte, 16))
+    if e, ok := err.(net.Error); !ok || !e.Timeout() {
+        t.Fatalf("Read error = %v, want timeout", err)
+    }
+    if time.Since(start) > 2 * time.Second {
+        t.Fatalf("Read returns after %s", time.Since(start))
+    }
+}
+
+
+func TestCryptCloseWrite(t *testing.T) {
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer ln.Close()
+
+    // the client half-closes after sending, and still reads the reply
+    replied := make(chan string, 1)
+    server := cryptPair(t, ln, func(conn net.Conn) {
+        defer conn.Close()
+        cconn, err := NewCryptConn(conn, "secret")
+        if err != nil {
+            t.Errorf("NewCryptConn error, %s", err)
+            replied <- ""
+            return
+        }
+        cconn.Write([]byte("hello"))
+        err = cconn.CloseWrite()
+        if err != nil {
+            t.Errorf("CloseWrite error, %s", err)
+        }
+        data, _ := ioutil.ReadAll(cconn)
+        replied <- string(data)
+    })
+    data, err := ioutil.ReadAll(server)
+    if err != nil || string(data) != "hello" {
+        t.Fatalf("ReadAll = %q, %v, want \"hello\"", data, err)
+    }
+    server.Write([]byte("bye"))
+    server.Close()
+    if reply := <-replied; reply != "bye" {
+        t.Fatalf("reply = %q, want \"bye\"", reply)
+    }
+}
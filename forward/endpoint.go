@@ -0,0 +1,435 @@
+/**
+* Filename: endpoint.go
+* Description: the sock endpoint, besides the legacy "method:address" form,
+*   the sock can be written as URI with its own protocol and options:
+*   [proto+]method://address[?option=value&...]
+*   tcp+listen://0.0.0.0:8080?backlog=128&keepalive=30s
+*   udp+conn://8.8.8.8:53?idle=5m
+*   unix+listen:///run/pf.sock?mode=0660
+*   tls-conn://1.2.3.4:443?server_name=example.com&ca=ca.pem
+*   the protocol of URI overrides the protocol of rule, so that a rule can
+*   forward between different protocols, such as tcp and unix socket.
+* Author: knownsec404
+* Time: 2020.10.23
+*/
+
+package forward
+
+import (
+    "errors"
+    "fmt"
+    "net"
+    "net/url"
+    "os"
+    "sort"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// the sock endpoint, it is parsed from the sock string
+type Endpoint struct {
+    // the protocol of sock, PORTFORWARD_PROTO_NIL means the protocol of rule
+    Protocol    uint8
+    Method      uint8
+    Address     string
+    Options     SockOptions
+}
+
+// the options of sock, they are given by the query of sock URI
+type SockOptions struct {
+    // the backlog of listen sock, 0 means the system default
+    Backlog     int
+    // the file mode of unix listen sock, 0 means the default by umask
+    Mode        os.FileMode
+    // the timeout settings of sock, it overrides the ones of rule, the
+    // timeouts of link (idle, lifetime and linger) are shared by both socks,
+    // the ones of sock1 override the ones of sock2
+    Timeouts    Timeouts
+    // the TLS options of tls sock, it overrides the ones of rule
+    TLS         TLSOptions
+}
+
+
+/**********************************************************************
+* @Function: ParseEndpoint(sock string) (Endpoint, error)
+* @Description: parse and check sock string, the legacy form
+*   "method:address" or the URI form "[proto+]method://address[?options]"
+* @Parameter: sock string, the sock string from command-line
+* @Return: (Endpoint, error), the endpoint and error
+**********************************************************************/
+func ParseEndpoint(sock string) (Endpoint, error) {
+    i := strings.Index(sock, "://")
+    if i < 0 {
+        method, address, err := parseLegacySock(sock)
+        return Endpoint{Method: method, Address: address}, err
+    }
+
+    var endpoint Endpoint
+    scheme, rest := sock[:i], sock[i + 3:]
+    method := scheme
+    if j := strings.Index(scheme, "+"); j >= 0 {
+        protocol, err := ParseProto(scheme[:j])
+        if err != nil {
+            return Endpoint{}, err
+        }
+        endpoint.Protocol = protocol
+        method = scheme[j + 1:]
+    }
+    m, err := parseMethod(method)
+    if err != nil {
+        return Endpoint{}, err
+    }
+    endpoint.Method = m
+
+    // the address has no "?", even the ipv6 address with zone
+    query := ""
+    if j := strings.Index(rest, "?"); j >= 0 {
+        rest, query = rest[:j], rest[j + 1:]
+    }
+    endpoint.Address = rest
+    err = endpoint.checkAddress()
+    if err != nil {
+        return Endpoint{}, fmt.Errorf("address: %s", err)
+    }
+
+    values, err := url.ParseQuery(query)
+    if err != nil {
+        return Endpoint{}, fmt.Errorf("invalid options [%s]", query)
+    }
+    // parse options in order, so that the error is stable
+    keys := make([]string, 0, len(values))
+    for key := range values {
+        keys = append(keys, key)
+    }
+    sort.Strings(keys)
+    for _, key := range keys {
+        if len(values[key]) != 1 {
+            return Endpoint{}, fmt.Errorf("%s: option is repeated", key)
+        }
+        err = endpoint.Options.set(key, values[key][0])
+        if err != nil {
+            return Endpoint{}, fmt.Errorf("%s: %s", key, err)
+        }
+    }
+    return endpoint, nil
+}
+
+
+/**********************************************************************
+* @Function: parseLegacySock(sock string) (uint8, string, error)
+* @Description: parse the legacy sock string "method:address"
+* @Parameter: sock string, the sock string
+* @Return: (uint8, string, error), the method, address and error
+**********************************************************************/
+func parseLegacySock(sock string) (uint8, string, error) {
+    // the proxy sock has no address, "socks5" or "socks5:"
+    method, err := parseMethod(strings.TrimSuffix(sock, ":"))
+    if err == nil && isProxyMethod(method) {
+        return method, "", nil
+    }
+
+    // split "method" and "address"
+    items := strings.SplitN(sock, ":", 2)
+    if len(items) != 2 {
+        return PORTFORWARD_SOCK_NIL, "",
+               errors.New("host format must [method:address:port]")
+    }
+    method, err = parseMethod(items[0])
+    if err != nil || isProxyMethod(method) {
+        errmsg := fmt.Sprintf("unknown method [%s]", items[0])
+        return PORTFORWARD_SOCK_NIL, "", errors.New(errmsg)
+    }
+    return method, items[1], nil
+}
+
+
+/**********************************************************************
+* @Function: parseMethod(name string) (uint8, error)
+* @Description: parse the sock method name, such as "listen", "tls-conn"
+* @Parameter: name string, the method name
+* @Return: (uint8, error), the method and error
+**********************************************************************/
+func parseMethod(name string) (uint8, error) {
+    switch strings.ToUpper(name) {
+    case "LISTEN":
+        return PORTFORWARD_SOCK_LISTEN, nil
+    case "CONN":
+        return PORTFORWARD_SOCK_CONN, nil
+    case "TLS-LISTEN":
+        return PORTFORWARD_SOCK_LISTEN | PORTFORWARD_SOCK_TLS, nil
+    case "TLS-CONN":
+        return PORTFORWARD_SOCK_CONN | PORTFORWARD_SOCK_TLS, nil
+    case "SOCKS5":
+        return PORTFORWARD_SOCK_SOCKS5, nil
+    case "HTTP-PROXY":
+        return PORTFORWARD_SOCK_HTTP, nil
+    }
+    return PORTFORWARD_SOCK_NIL, fmt.Errorf("unknown method [%s]", name)
+}
+
+
+/**********************************************************************
+* @Function: isProxyMethod(method uint8) (bool)
+* @Description: check whether the method is proxy sock (socks5/http-proxy)
+* @Parameter: method uint8, the sock method
+* @Return: bool, true if it is proxy sock
+**********************************************************************/
+func isProxyMethod(method uint8) (bool) {
+    return method == PORTFORWARD_SOCK_SOCKS5 || method == PORTFORWARD_SOCK_HTTP
+}
+
+
+/**********************************************************************
+* @Function: (this Endpoint) checkAddress() (error)
+* @Description: check the address of URI by the protocol, the proxy sock
+*   has no address, the unix sock has the path, and the tcp/udp sock has
+*   "host:port". the address is not checked if there is no protocol
+* @Parameter: nil
+* @Return: error, the error
+**********************************************************************/
+func (this Endpoint) checkAddress() (error) {
+    if isProxyMethod(this.Method) {
+        if this.Address != "" {
+            return errors.New("proxy sock has no address")
+        }
+        return nil
+    }
+    if this.Address == "" {
+        return errors.New("address is empty")
+    }
+    if this.Protocol == PORTFORWARD_PROTO_TCP ||
+       this.Protocol == PORTFORWARD_PROTO_UDP {
+        _, _, err := net.SplitHostPort(this.Address)
+        return err
+    }
+    return nil
+}
+
+
+/**********************************************************************
+* @Function: (this *SockOptions) set(key string, value string) (error)
+* @Description: set the option of sock URI
+* @Parameter: key string, the option name
+* @Parameter: value string, the option value
+* @Return: error, the error of value
+**********************************************************************/
+func (this *SockOptions) set(key string, value string) (error) {
+    // the duration which must be positive
+    duration := func(d *time.Duration) (error) {
+        v, err := time.ParseDuration(value)
+        if err != nil || v <= 0 {
+            return fmt.Errorf("invalid duration [%s]", value)
+        }
+        *d = v
+        return nil
+    }
+    // the string which must not be empty
+    str := func(s *string) (error) {
+        if value == "" {
+            return errors.New("value is empty")
+        }
+        *s = value
+        return nil
+    }
+    boolean := func(b *bool) (error) {
+        v, err := strconv.ParseBool(value)
+        if err != nil {
+            return fmt.Errorf("invalid bool [%s]", value)
+        }
+        *b = v
+        return nil
+    }
+
+    switch key {
+    case "backlog":
+        v, err := strconv.Atoi(value)
+        if err != nil || v <= 0 {
+            return fmt.Errorf("invalid number [%s]", value)
+        }
+        this.Backlog = v
+    case "mode":
+        v, err := strconv.ParseUint(value, 8, 32)
+        if err != nil || v == 0 || v > 0777 {
+            return fmt.Errorf("invalid file mode [%s]", value)
+        }
+        this.Mode = os.FileMode(v)
+    case "keepalive":
+        // the negative keepalive disables it
+        v, err := time.ParseDuration(value)
+        if err != nil || v == 0 {
+            return fmt.Errorf("invalid duration [%s]", value)
+        }
+        this.Timeouts.Keepalive = v
+    case "dial":
+        return duration(&this.Timeouts.Dial)
+    case "idle":
+        return duration(&this.Timeouts.UDPIdle)
+    case "poll":
+        return duration(&this.Timeouts.AcceptPoll)
+    case "cert":
+        return str(&this.TLS.Cert)
+    case "key":
+        return str(&this.TLS.Key)
+    case "ca":
+        return str(&this.TLS.CA)
+    case "server_name":
+        return str(&this.TLS.ServerName)
+    case "client_auth":
+        return boolean(&this.TLS.ClientAuth)
+    case "insecure":
+        return boolean(&this.TLS.Insecure)
+    default:
+        return errors.New("unknown option")
+    }
+    return nil
+}
+
+
+/**********************************************************************
+* @Function: (this SockOptions) check(protocol uint8, method uint8) (error)
+* @Description: check whether the options work with the protocol and
+*   method of sock
+* @Parameter: protocol uint8, the protocol of sock
+* @Parameter: method uint8, the method of sock
+* @Return: error, the error with option name
+**********************************************************************/
+func (this SockOptions) check(protocol uint8, method uint8) (error) {
+    listen := method &^ PORTFORWARD_SOCK_TLS == PORTFORWARD_SOCK_LISTEN
+    conn := method &^ PORTFORWARD_SOCK_TLS == PORTFORWARD_SOCK_CONN
+    tls := method & PORTFORWARD_SOCK_TLS != 0
+    udp := protocol == PORTFORWARD_PROTO_UDP
+    checks := []struct {
+        name    string
+        set     bool
+        ok      bool
+        errmsg  string
+    }{
+        {"backlog", this.Backlog != 0, listen && !udp,
+         "only supports tcp and unix listen"},
+        {"mode", this.Mode != 0, listen && protocol == PORTFORWARD_PROTO_UNIX,
+         "only supports unix listen"},
+        {"keepalive", this.Timeouts.Keepalive != 0,
+         protocol == PORTFORWARD_PROTO_TCP, "only supports tcp protocol"},
+        {"dial", this.Timeouts.Dial != 0, conn, "only supports conn method"},
+        {"idle", this.Timeouts.UDPIdle != 0, udp, "only supports udp protocol"},
+        {"poll", this.Timeouts.AcceptPoll != 0, listen && udp,
+         "only supports udp listen"},
+        {"timeout-pairing", this.Timeouts.Pairing != 0, listen,
+         "only supports listen method"},
+        {"cert", this.TLS.Cert != "", tls, "only supports tls method"},
+        {"key", this.TLS.Key != "", tls, "only supports tls method"},
+        {"ca", this.TLS.CA != "", tls, "only supports tls method"},
+        {"client_auth", this.TLS.ClientAuth, tls && listen,
+         "only supports tls-listen"},
+        {"server_name", this.TLS.ServerName != "", tls && conn,
+         "only supports tls-conn"},
+        {"insecure", this.TLS.Insecure, tls && conn, "only supports tls-conn"},
+    }
+    for _, c := range checks {
+        if c.set && !c.ok {
+            return fmt.Errorf("%s: %s", c.name, c.errmsg)
+        }
+    }
+    return nil
+}
+
+
+/**********************************************************************
+* @Function: (this TLSOptions) merge(other TLSOptions) (TLSOptions)
+* @Description: set the empty field to the field of other options
+* @Parameter: other TLSOptions, the options of lower priority
+* @Return: TLSOptions, the merged TLS options
+**********************************************************************/
+func (this TLSOptions) merge(other TLSOptions) (TLSOptions) {
+    if this.Cert == "" {
+        this.Cert = other.Cert
+    }
+    if this.Key == "" {
+        this.Key = other.Key
+    }
+    if this.CA == "" {
+        this.CA = other.CA
+    }
+    if this.ServerName == "" {
+        this.ServerName = other.ServerName
+    }
+    this.ClientAuth = this.ClientAuth || other.ClientAuth
+    this.Insecure = this.Insecure || other.Insecure
+    return this
+}
+
+
+/**********************************************************************
+* @Function: (this Endpoint) String() (string)
+* @Description: format the endpoint as sock string, it is the legacy form
+*   if there is neither protocol nor option, otherwise the URI form
+* @Parameter: nil
+* @Return: string, the sock string
+**********************************************************************/
+func (this Endpoint) String() (string) {
+    if this.Protocol == PORTFORWARD_PROTO_NIL && this.Options == (SockOptions{}) {
+        return FormatSock(this.Method, this.Address)
+    }
+
+    scheme := strings.TrimSuffix(FormatSock(this.Method, ""), ":")
+    if this.Protocol != PORTFORWARD_PROTO_NIL {
+        scheme = FormatProto(this.Protocol) + "+" + scheme
+    }
+    values := url.Values{}
+    options := this.Options
+    if options.Backlog != 0 {
+        values.Set("backlog", strconv.Itoa(options.Backlog))
+    }
+    if options.Mode != 0 {
+        values.Set("mode", fmt.Sprintf("%04o", uint32(options.Mode)))
+    }
+    durations := map[string]time.Duration{
+        "keepalive":    options.Timeouts.Keepalive,
+        "dial":         options.Timeouts.Dial,
+        "idle":         options.Timeouts.UDPIdle,
+        "poll":         options.Timeouts.AcceptPoll,
+    }
+    for key, d := range durations {
+        if d != 0 {
+            values.Set(key, d.String())
+        }
+    }
+    strs := map[string]string{
+        "cert":         options.TLS.Cert,
+        "key":          options.TLS.Key,
+        "ca":           options.TLS.CA,
+        "server_name":  options.TLS.ServerName,
+    }
+    for key, s := range strs {
+        if s != "" {
+            values.Set(key, s)
+        }
+    }
+    if options.TLS.ClientAuth {
+        values.Set("client_auth", "true")
+    }
+    if options.TLS.Insecure {
+        values.Set("insecure", "true")
+    }
+
+    sock := scheme + "://" + this.Address
+    if len(values) > 0 {
+        sock += "?" + values.Encode()
+    }
+    return sock
+}
+
+
+/**********************************************************************
+* @Function: (this Args) Endpoint(index int) (Endpoint)
+* @Description: get the endpoint of sock1 or sock2
+* @Parameter: index int, the sock index (1 or 2)
+* @Return: Endpoint, the endpoint
+**********************************************************************/
+func (this Args) Endpoint(index int) (Endpoint) {
+    if index == 2 {
+        return Endpoint{this.Proto2, this.Method2, this.Addr2, this.Options2}
+    }
+    return Endpoint{this.Proto1, this.Method1, this.Addr1, this.Options1}
+}
@@ -0,0 +1,95 @@
+/**
+* Filename: endpoint_test.go
+* Description: the unit tests of sock endpoint and options
+* Author: knownsec404
+* Time: 2020.10.23
+*/
+
+package forward
+
+import (
+    "net"
+    "testing"
+    "time"
+)
+
+
+func TestCheckArgsSockTimeouts(t *testing.T) {
+    rule := func(sock2 Timeouts) (Args) {
+        return Args{
+            Protocol:   PORTFORWARD_PROTO_TCP,
+            Method1:    PORTFORWARD_SOCK_LISTEN,
+            Addr1:      "127.0.0.1:0",
+            Method2:    PORTFORWARD_SOCK_CONN,
+            Addr2:      "127.0.0.1:1",
+            Options2:   SockOptions{Timeouts: sock2},
+        }
+    }
+    cases := []struct {
+        timeouts    Timeouts
+        errmsg      string
+    }{
+        {Timeouts{Dial: time.Second, Keepalive: time.Second}, ""},
+        {Timeouts{Idle: time.Second, Lifetime: time.Second,
+                  Linger: time.Second}, ""},
+        {Timeouts{Pairing: time.Second},
+         "sock2: timeout-pairing: only supports listen method"},
+    }
+    for _, c := range cases {
+        err := CheckArgs(rule(c.timeouts))
+        errmsg := ""
+        if err != nil {
+            errmsg = err.Error()
+        }
+        if errmsg != c.errmsg {
+            t.Errorf("CheckArgs(%+v) = %q, want %q", c.timeouts, errmsg,
+                     c.errmsg)
+        }
+    }
+}
+
+
+func TestSockTimeoutsIdle(t *testing.T) {
+    // the B point which never replies
+    target, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer target.Close()
+    go func() {
+        for {
+            conn, err := target.Accept()
+            if err != nil {
+                return
+            }
+            defer conn.Close()
+        }
+    }()
+
+    // the idle timeout of sock overrides the one of rule
+    args := testRule(t, "", target.Addr().String())
+    args.Timeouts.Idle = time.Hour
+    args.Options2.Timeouts.Idle = 200 * time.Millisecond
+    testForwarder(t, args)
+
+    var conn net.Conn
+    for i := 0; i < 50; i++ {
+        conn, err = net.Dial("tcp", args.Addr1)
+        if err == nil {
+            break
+        }
+        time.Sleep(20 * time.Millisecond)
+    }
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer conn.Close()
+    conn.SetDeadline(time.Now().Add(5 * time.Second))
+    _, err = conn.Read(make([]byte, 16))
+    if err == nil {
+        t.Fatal("Read() = nil, want the link reset by idle timeout")
+    }
+    if e, ok := err.(net.Error); ok && e.Timeout() {
+        t.Fatal("the link is not reset by the idle timeout of sock")
+    }
+}
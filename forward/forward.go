@@ -0,0 +1,1202 @@
+/**
+* Filename: forward.go
+* Description: the PortForward main logic implement, the "Forwarder" runs a
+*   single forwarding rule and can be embedded by other programs. Three
+*   working modes are provided:
+*   1.Conn<=>Conn: dial A remote server, dial B remote server, connected
+*   2.Listen<=>Conn: listen local server, dial remote server, connected
+*   3.Listen<=>Listen: listen A local server, listen B local server, connected
+* Author: knownsec404
+* Time: 2020.09.23
+*/
+
+package forward
+
+import (
+    "context"
+    "errors"
+    "io"
+    "net"
+    "sort"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+//
+const PORTFORWARD_PROTO_NIL   uint8 = 0x00
+const PORTFORWARD_PROTO_TCP   uint8 = 0x10
+const PORTFORWARD_PROTO_UDP   uint8 = 0x20
+const PORTFORWARD_PROTO_UNIX  uint8 = 0x40
+//
+const PORTFORWARD_SOCK_NIL    uint8 = 0x00
+const PORTFORWARD_SOCK_LISTEN uint8 = 0x01
+const PORTFORWARD_SOCK_CONN   uint8 = 0x02
+// the sock modifier, combined with listen/conn method
+const PORTFORWARD_SOCK_TLS    uint8 = 0x04
+// the proxy server as the B point, the destination is chosen per link
+const PORTFORWARD_SOCK_SOCKS5 uint8 = 0x08
+const PORTFORWARD_SOCK_HTTP   uint8 = 0x10
+
+// the PortForward network interface
+type Conn interface {
+    // Read reads data from the connection.
+    Read(b []byte) (n int, err error)
+    // Write writes data to the connection.
+    Write(b []byte) (n int, err error)
+    // Close closes the connection.
+    Close() (error)
+    // RemoteAddr returns the remote network address.
+    RemoteAddr() (net.Addr)
+}
+
+/**********************************************************************
+* @Function: setDeadline(conn Conn, t time.Time)
+* @Description: set the read and write deadline of connection, if the
+*   connection supports it
+* @Parameter: conn Conn, the connection
+* @Parameter: t time.Time, the deadline, zero means no deadline
+* @Return: nil
+**********************************************************************/
+func setDeadline(conn Conn, t time.Time) {
+    if c, ok := conn.(interface{ SetDeadline(time.Time) error }); ok {
+        c.SetDeadline(t)
+    }
+}
+
+// the PortForward launch arguemnt
+type Args struct {
+    // the rule name, used in log lines
+    Name        string
+    // the log level of rule, such as "debug", empty means the global one
+    LogLevel    string
+    // the protocol of rule, the sock with its own protocol overrides it
+    Protocol    uint8
+    // sock1
+    Proto1      uint8
+    Method1     uint8
+    Addr1       string
+    Options1    SockOptions
+    TLS1        TLSOptions
+    Auth1       string
+    Crypt1      string
+    Upstream1   []string
+    Mux1        bool
+    // sock2
+    Proto2      uint8
+    Method2     uint8
+    Addr2       string
+    Options2    SockOptions
+    TLS2        TLSOptions
+    Auth2       string
+    Crypt2      string
+    Upstream2   []string
+    Mux2        bool
+    // the number of idle A point sockets in conn<=>conn mode, and pending
+    // sockets of each end in listen<=>listen mode, default is 1
+    Pool        int
+    // the retry policy of dial failures
+    Retry       RetryPolicy
+    // the timeout settings
+    Timeouts    Timeouts
+    // the authentication of proxy sock (socks5/http-proxy)
+    ProxyAuth   ProxyAuth
+}
+
+// the sock launch function of listen method
+type ListenFunc func(ctx context.Context, address string, clientc chan Conn,
+                     logger Logger)
+// the sock launch function of conn method
+type DialFunc func(address string) (Conn, error)
+// the handshake function of accepted connection, it returns the connection
+// which is eligible for forwarding
+type HandshakeFunc func(conn Conn) (Conn, error)
+// the function to get the B point socket for the A point socket of link
+type TargetFunc func(sock1 Conn) (Conn, error)
+
+// the username/password authentication of proxy sock
+type ProxyAuth struct {
+    Username    string  `json:"username"`
+    Password    string  `json:"password"`
+}
+
+// the communication link between two sockets
+type link struct {
+    id          int
+    sock1       Conn
+    sock2       Conn
+    stats       *LinkStats
+    // the close reason which is set when the link is closed on purpose
+    reason      string
+}
+
+// the PortForward forwarder, runs a single forwarding rule, each forwarder
+// owns its lifecycle and can be shut down independently
+type Forwarder struct {
+    // the running aggregate of links, it is the first field, so that it is
+    // 64-bit aligned for atomic
+    stats       RuleStats
+    args        Args
+    logger      Logger
+    // the timeout settings of links, the ones of socks override the ones of
+    // rule, it is set by "Start()"
+    timeouts    Timeouts
+    // the context of accepting new links, it is canceled when the
+    // forwarder is stopped or shutting down
+    ctx         context.Context
+    cancel      context.CancelFunc
+    // all of the goroutines started by forwarder
+    wg          sync.WaitGroup
+    done        chan bool
+    // the active links
+    mutex       sync.Mutex
+    links       map[int]*link
+    count       int
+    // the links have been closed forcibly, the later links are rejected
+    forced      bool
+}
+
+
+/**********************************************************************
+* @Function: NewForwarder(args Args) (*Forwarder)
+* @Description: initialize Forwarder structure by launch arguments, the
+*   default logger is "StdLogger"
+* @Parameter: args Args, the launch arguments
+* @Return: *Forwarder, the new Forwarder structure pointer
+**********************************************************************/
+func NewForwarder(args Args) (*Forwarder) {
+    return &Forwarder{
+        args:       args,
+        logger:     ruleLogger(StdLogger{}, args),
+        done:       make(chan bool),
+        links:      make(map[int]*link),
+    }
+}
+
+
+/**********************************************************************
+* @Function: (this *Forwarder) SetLogger(logger Logger)
+* @Description: set the logger of forwarder, the rule name will be added
+*   to each log line, it must be called before "Start()"
+* @Parameter: logger Logger, the logger
+* @Return: nil
+**********************************************************************/
+func (this *Forwarder) SetLogger(logger Logger) {
+    this.logger = ruleLogger(logger, this.args)
+}
+
+
+/**********************************************************************
+* @Function: ruleLogger(logger Logger, args Args) (Logger)
+* @Description: wrap logger with the rule name and log level of rule
+* @Parameter: logger Logger, the wrapped logger
+* @Parameter: args Args, the launch arguments of rule
+* @Return: Logger, the logger of rule
+**********************************************************************/
+func ruleLogger(logger Logger, args Args) (Logger) {
+    return WithLogLevel(NewRuleLogger(logger, args.Name), args.LogLevel)
+}
+
+
+/**********************************************************************
+* @Function: (this *Forwarder) Start(ctx context.Context) (error)
+* @Description: launch PortForward working mode by arguments, the working
+*   mode runs in background until "Stop()"/"Shutdown()" is called or "ctx"
+*   is done, the forwarder can only be started once
+* @Parameter: ctx context.Context, the context which stops the forwarder
+* @Return: error, the error of launch arguments
+**********************************************************************/
+func (this *Forwarder) Start(ctx context.Context) (error) {
+    args := this.args
+    // the TLS modifier only works with the sock launch function
+    method1 := args.Method1 &^ PORTFORWARD_SOCK_TLS
+    method2 := args.Method2 &^ PORTFORWARD_SOCK_TLS
+    listen1, dial1, err := sockFunc(args, 1, this.logger)
+    if err != nil {
+        return err
+    }
+    listen2, dial2, err := sockFunc(args, 2, this.logger)
+    if err != nil {
+        return err
+    }
+    dial1, dial2 = this.countDial(dial1), this.countDial(dial2)
+
+    // the proxy sock relays udp only if the A point socket is accepted
+    // from the proxy client, but not the tunnel of another PortForward
+    direct1 := method1 == PORTFORWARD_SOCK_LISTEN && !args.Mux1 &&
+               args.Auth1 == "" && args.Crypt1 == ""
+    direct2 := method2 == PORTFORWARD_SOCK_LISTEN && !args.Mux2 &&
+               args.Auth2 == "" && args.Crypt2 == ""
+    target1 := this.targetFunc(method1, dial1, args.Addr1, direct2)
+    target2 := this.targetFunc(method2, dial2, args.Addr2, direct1)
+    // the conn and proxy sock can be the B point
+    isProxy := func(method uint8) (bool) {
+        return method == PORTFORWARD_SOCK_SOCKS5 ||
+               method == PORTFORWARD_SOCK_HTTP
+    }
+    isTarget := func(method uint8) (bool) {
+        return method == PORTFORWARD_SOCK_CONN || isProxy(method)
+    }
+
+    var mode func()
+    //
+    if method1 == PORTFORWARD_SOCK_CONN && isTarget(method2) {
+        // sock1 conn, sock2 conn
+        mode = func() { this.connConn(dial1, args.Addr1, target2) }
+    } else if isProxy(method1) && method2 == PORTFORWARD_SOCK_CONN {
+        // sock1 proxy, sock2 conn
+        mode = func() { this.connConn(dial2, args.Addr2, target1) }
+    } else if isTarget(method1) && method2 == PORTFORWARD_SOCK_LISTEN {
+        // sock1 conn, sock2 listen
+        mode = func() { this.listenConn(listen2, args.Addr2, target1) }
+    } else if method1 == PORTFORWARD_SOCK_LISTEN && isTarget(method2) {
+        // sock1 listen, sock2 conn
+        mode = func() { this.listenConn(listen1, args.Addr1, target2) }
+    } else if method1 == PORTFORWARD_SOCK_LISTEN &&
+        method2 == PORTFORWARD_SOCK_LISTEN {
+        // sock1 listen , sock2 listen
+        mode = func() { this.listenListen(listen1, args.Addr1, listen2, args.Addr2) }
+    } else {
+        return errors.New("unknown forward method")
+    }
+    if this.ctx != nil {
+        return errors.New("forwarder has been started")
+    }
+    // the timeouts of link are shared by both socks, sock1 is preferred
+    this.timeouts = args.Options1.Timeouts.merge(args.Options2.Timeouts)
+    this.timeouts = this.timeouts.merge(args.Timeouts).withDefaults()
+    // the listeners count connections into the rule statistics by context
+    this.ctx, this.cancel = context.WithCancel(
+                                withStats(context.Background(), &this.stats))
+
+    this.goroutine(mode)
+    go func() {
+        this.wg.Wait()
+        this.logger.Info("rule exited, %s", this.Stats())
+        close(this.done)
+    }()
+
+    // stop the forwarder when parent context is done
+    go func() {
+        select {
+        case <-ctx.Done():
+            this.Stop()
+        case <-this.done:
+        }
+    }()
+    return nil
+}
+
+
+/**********************************************************************
+* @Function: (this *Forwarder) Stop()
+* @Description: stop the forwarder immediately, stop accepting and close
+*   all of the active links, it can be called more than once
+* @Parameter: nil
+* @Return: nil
+**********************************************************************/
+func (this *Forwarder) Stop() {
+    if this.cancel == nil {
+        return
+    }
+    this.cancel()
+    this.closeLinks()
+}
+
+
+/**********************************************************************
+* @Function: (this *Forwarder) Shutdown(ctx context.Context) (error)
+* @Description: shutdown the forwarder gracefully, close listeners and stop
+*   accepting at first, then wait for the active links to drain; when "ctx"
+*   is done, the remaining and later connected links are closed forcibly.
+*   it returns only when every goroutine of the forwarder has exited
+* @Parameter: ctx context.Context, the deadline of draining links
+* @Return: error, the "ctx" error if links are closed forcibly
+**********************************************************************/
+func (this *Forwarder) Shutdown(ctx context.Context) (error) {
+    if this.cancel == nil {
+        return nil
+    }
+    this.cancel()
+
+    // the link of in-flight dial may be connected after the active links
+    // have drained, so wait for the goroutines rather than the links
+    select {
+    case <-this.done:
+        return nil
+    case <-ctx.Done():
+    }
+    this.logger.Warn("shutdown timeout, close %d active links",
+                     this.activeLinks())
+    // the later links are rejected by "connect()" after it
+    this.closeLinks()
+    this.Wait()
+    return ctx.Err()
+}
+
+
+/**********************************************************************
+* @Function: (this *Forwarder) Wait()
+* @Description: wait until every goroutine of the forwarder has exited
+* @Parameter: nil
+* @Return: nil
+**********************************************************************/
+func (this *Forwarder) Wait() {
+    <-this.done
+}
+
+
+/**********************************************************************
+* @Function: sockFunc(args Args, index int, logger Logger) (ListenFunc,
+*   DialFunc, error)
+* @Description: get sock launch function by protocol and sock options
+* @Parameter: args Args, the launch arguments
+* @Parameter: index int, the sock index (1 or 2)
+* @Parameter: logger Logger, the logger of the sock layers
+* @Return: (ListenFunc, DialFunc, error), the launch function of listen
+*   method and conn method, and error
+**********************************************************************/
+func sockFunc(args Args, index int, logger Logger) (ListenFunc, DialFunc,
+    error) {
+    endpoint := args.Endpoint(index)
+    opts := args.TLS1
+    secret, crypt, upstream := args.Auth1, args.Crypt1, args.Upstream1
+    mux := args.Mux1
+    if index == 2 {
+        opts = args.TLS2
+        secret, crypt, upstream = args.Auth2, args.Crypt2, args.Upstream2
+        mux = args.Mux2
+    }
+    method, address := endpoint.Method, endpoint.Address
+    proto := args.Protocol
+    if endpoint.Protocol != PORTFORWARD_PROTO_NIL {
+        proto = endpoint.Protocol
+    }
+
+    // the options of sock override the ones of rule
+    options := endpoint.Options
+    err := options.check(proto, method)
+    if err != nil {
+        return nil, nil, err
+    }
+    // the "idle" option of udp conn sock is for the dialed connection
+    if proto == PORTFORWARD_PROTO_UDP && method == PORTFORWARD_SOCK_CONN &&
+       options.Timeouts.UDPConnIdle == 0 {
+        options.Timeouts.UDPConnIdle = options.Timeouts.UDPIdle
+    }
+    options.Timeouts = options.Timeouts.merge(args.Timeouts)
+    opts = options.TLS.merge(opts)
+
+    // the tcp connection is dialed through the upstream proxies
+    timeouts := options.Timeouts
+    var listen ListenFunc = options.ListenTCP
+    dial, err := ConnUpstream(upstream, timeouts.ConnTCP)
+    if err != nil {
+        return nil, nil, err
+    }
+    if len(upstream) > 0 {
+        if proto != PORTFORWARD_PROTO_TCP {
+            return nil, nil, errors.New("upstream only supports tcp protocol")
+        }
+        if method &^ PORTFORWARD_SOCK_TLS == PORTFORWARD_SOCK_LISTEN {
+            return nil, nil, errors.New("upstream does not work with listen")
+        }
+    }
+
+    // the proxy sock dials the destination of each link by itself
+    if method == PORTFORWARD_SOCK_SOCKS5 || method == PORTFORWARD_SOCK_HTTP {
+        if proto != PORTFORWARD_PROTO_TCP {
+            return nil, nil, errors.New("proxy only supports tcp protocol")
+        }
+        if mux {
+            return nil, nil, errors.New("mux does not work with proxy")
+        }
+        return nil, dial, nil
+    }
+
+    if proto == PORTFORWARD_PROTO_UDP {
+        listen = timeouts.ListenUDP
+        dial = timeouts.ConnUDP
+    } else if proto == PORTFORWARD_PROTO_UNIX {
+        listen = options.ListenUnix
+        dial = timeouts.ConnUnix
+    }
+
+    // the TLS transport
+    if method & PORTFORWARD_SOCK_TLS != 0 {
+        if proto == PORTFORWARD_PROTO_UDP {
+            return nil, nil, errors.New("tls does not support udp protocol")
+        }
+        if method &^ PORTFORWARD_SOCK_TLS == PORTFORWARD_SOCK_LISTEN {
+            config, err := opts.ServerConfig()
+            if err != nil {
+                return nil, nil, err
+            }
+            base := listen
+            handshake := func(raw Conn) (Conn, error) {
+                return ServerTLS(raw, config)
+            }
+            listen = func(ctx context.Context, address string,
+                clientc chan Conn, logger Logger) {
+                ListenHandshake(ctx, address, clientc, logger, base, handshake)
+            }
+        } else {
+            config, err := opts.ClientConfig(address)
+            if err != nil {
+                return nil, nil, err
+            }
+            base := dial
+            dial = func(address string) (Conn, error) {
+                conn, err := base(address)
+                if err != nil {
+                    return nil, err
+                }
+                return ClientTLS(conn, config)
+            }
+        }
+    }
+
+    // the pre-shared-key authentication, it works on the transport
+    if secret != "" {
+        if proto == PORTFORWARD_PROTO_UDP {
+            return nil, nil, errors.New("auth does not support udp protocol")
+        }
+        listen = ListenAuth(listen, secret)
+        dial = ConnAuth(dial, secret)
+    }
+
+    // the symmetric encryption, it works on the authenticated transport
+    if crypt != "" {
+        if proto == PORTFORWARD_PROTO_UDP {
+            return nil, nil, errors.New("crypt does not support udp protocol")
+        }
+        listen = ListenCrypt(listen, crypt)
+        dial = ConnCrypt(dial, crypt)
+    }
+
+    // the multiplexing, the streams share the whole transport
+    if mux {
+        if proto == PORTFORWARD_PROTO_UDP {
+            return nil, nil, errors.New("mux does not support udp protocol")
+        }
+        listen = ListenMux(listen)
+        dial = ConnMux(dial, logger)
+    }
+    return listen, dial, nil
+}
+
+
+/**********************************************************************
+* @Function: (this *Forwarder) targetFunc(method uint8, dial DialFunc,
+*   address string, direct bool) (TargetFunc)
+* @Description: get the function to get the B point socket by method
+* @Parameter: method uint8, the sock method of B point
+* @Parameter: dial DialFunc, the launch function of conn method
+* @Parameter: address string, the sock address of B point
+* @Parameter: direct bool, the A point socket is accepted from the client
+*   directly, so that the udp relay of socks5 can be reached
+* @Return: TargetFunc, the function to get the B point socket
+**********************************************************************/
+func (this *Forwarder) targetFunc(method uint8, dial DialFunc,
+    address string, direct bool) (TargetFunc) {
+    if method == PORTFORWARD_SOCK_SOCKS5 {
+        return Socks5Target(this.args.ProxyAuth, dial, direct, this.logger)
+    } else if method == PORTFORWARD_SOCK_HTTP {
+        return HTTPProxyTarget(this.args.ProxyAuth, dial, this.logger)
+    }
+    return func(sock1 Conn) (Conn, error) {
+        retry := newBackoff(this.args.Retry)
+        for {
+            this.logger.Info("dial B point with sock2 [%s]", address)
+            sock2, err := dial(address)
+            if err == nil || retry.attempts >= retry.policy.DialRetries {
+                return sock2, err
+            }
+            delay := retry.Next()
+            this.logger.Warn("%s, retry(%d/%d) in %s", err, retry.attempts,
+                             retry.policy.DialRetries, delay.Round(time.Millisecond))
+            if !this.sleep(delay) {
+                return nil, err
+            }
+        } // end for
+    }
+}
+
+
+/**********************************************************************
+* @Function: (this *Forwarder) countDial(dial DialFunc) (DialFunc)
+* @Description: get the dial function which counts the failed dials
+* @Parameter: dial DialFunc, the dial function, it may be nil
+* @Return: DialFunc, the dial function with counting
+**********************************************************************/
+func (this *Forwarder) countDial(dial DialFunc) (DialFunc) {
+    if dial == nil {
+        return nil
+    }
+    return func(address string) (Conn, error) {
+        conn, err := dial(address)
+        if err != nil {
+            atomic.AddInt64(&this.stats.DialFailed, 1)
+        }
+        return conn, err
+    }
+}
+
+
+/**********************************************************************
+* @Function: (this *Forwarder) exited() (bool)
+* @Description: check whether the forwarder has exited
+* @Parameter: nil
+* @Return: bool, true if every goroutine of the forwarder has exited
+**********************************************************************/
+func (this *Forwarder) exited() (bool) {
+    select {
+    case <-this.done:
+        return true
+    default:
+        return false
+    }
+}
+
+
+/**********************************************************************
+* @Function: (this *Forwarder) goroutine(foo func())
+* @Description: launch a goroutine which is managed by the forwarder
+* @Parameter: foo func(), the goroutine function
+* @Return: nil
+**********************************************************************/
+func (this *Forwarder) goroutine(foo func()) {
+    this.wg.Add(1)
+    go func() {
+        defer this.wg.Done()
+        foo()
+    }()
+}
+
+
+/**********************************************************************
+* @Function: (this *Forwarder) nextId() (int)
+* @Description: allocate the id of new communication link
+* @Parameter: nil
+* @Return: int, the link id
+**********************************************************************/
+func (this *Forwarder) nextId() (int) {
+    this.mutex.Lock()
+    defer this.mutex.Unlock()
+    this.count += 1
+    return this.count
+}
+
+
+/**********************************************************************
+* @Function: (this *Forwarder) connect(id int, sock1 Conn, sock2 Conn)
+* @Description: register a new link and connect two sockets by
+*   "ConnectSock()", the link is removed after it exited
+* @Parameter: id int, the communication link id
+* @Parameter: sock1 Conn, the first socket object
+* @Parameter: sock2 Conn, the second socket object
+* @Return: nil
+**********************************************************************/
+func (this *Forwarder) connect(id int, sock1 Conn, sock2 Conn) {
+    this.mutex.Lock()
+    if this.forced {
+        this.mutex.Unlock()
+        sock1.Close()
+        sock2.Close()
+        return
+    }
+    stats := &LinkStats{
+        Id:         id,
+        Rule:       this.args.Name,
+        Addr1:      sock1.RemoteAddr().String(),
+        Addr2:      sock2.RemoteAddr().String(),
+        Start:      time.Now(),
+    }
+    l := &link{id: id, sock1: sock1, sock2: sock2, stats: stats}
+    this.links[l.id] = l
+    this.mutex.Unlock()
+    atomic.AddInt64(&this.stats.Links, 1)
+    atomic.AddInt64(&this.stats.Active, 1)
+
+    // count the data read from A point as "up", and B point as "down"
+    sock1 = &countConn{Conn: sock1,
+                       traffic: []*Traffic{&stats.Up, &this.stats.Up}}
+    sock2 = &countConn{Conn: sock2,
+                       traffic: []*Traffic{&stats.Down, &this.stats.Down}}
+
+    // the link without traffic or living too long is reset by the watchdog
+    timeouts := this.timeouts
+    done := make(chan bool)
+    reason := make(chan string, 1)
+    if timeouts.Idle > 0 || timeouts.Lifetime > 0 {
+        var watchdog func() (string)
+        sock1, sock2, watchdog = watchLink(sock1, sock2, timeouts.Idle,
+                                           timeouts.Lifetime, done)
+        this.goroutine(func() {
+            reason <- watchdog()
+        })
+    } else {
+        reason <- ""
+    }
+
+    logger := WithFields(this.logger, Field{"link", id})
+    this.goroutine(func() {
+        connectSock(id, sock1, sock2, timeouts.Linger, logger)
+        close(done)
+
+        // the close reason of link
+        r := <-reason
+        this.mutex.Lock()
+        if r == "" && l.reason != "" {
+            r = l.reason
+        } else if r == "" && this.forced {
+            r = "shutdown"
+        } else if r == "" {
+            r = "closed by peer"
+        }
+        stats.End = time.Now()
+        stats.Reason = r
+        delete(this.links, id)
+        this.mutex.Unlock()
+        atomic.AddInt64(&this.stats.Active, -1)
+
+        // log the summary of link
+        summary := stats.snapshot()
+        WithFields(logger, Field{"addr1", summary.Addr1},
+                   Field{"addr2", summary.Addr2},
+                   Field{"up_bytes", summary.Up.Bytes},
+                   Field{"down_bytes", summary.Down.Bytes},
+                   Field{"reason", summary.Reason}).Info("link closed, %s",
+                                                         summary)
+    })
+}
+
+
+/**********************************************************************
+* @Function: (this *Forwarder) linkLogger(id int, sock Conn) (Logger)
+* @Description: get the logger of link with the addresses of socket
+* @Parameter: id int, the communication link id
+* @Parameter: sock Conn, the socket of A point or B point
+* @Return: Logger, the logger with fields "link", "remote" and "local" if
+*   the socket has local address
+**********************************************************************/
+func (this *Forwarder) linkLogger(id int, sock Conn) (Logger) {
+    fields := []Field{{"link", id}, {"remote", sock.RemoteAddr()}}
+    if s, ok := sock.(interface{ LocalAddr() (net.Addr) }); ok {
+        fields = append(fields, Field{"local", s.LocalAddr()})
+    }
+    return WithFields(this.logger, fields...)
+}
+
+
+/**********************************************************************
+* @Function: (this *Forwarder) Stats() (RuleStats)
+* @Description: get the running aggregate of the links of rule
+* @Parameter: nil
+* @Return: RuleStats, the snapshot of rule statistics
+**********************************************************************/
+func (this *Forwarder) Stats() (RuleStats) {
+    return this.stats.snapshot()
+}
+
+
+/**********************************************************************
+* @Function: (this *Forwarder) Links() ([]LinkStats)
+* @Description: get the statistics of active links, ordered by link id
+* @Parameter: nil
+* @Return: []LinkStats, the snapshots of link statistics
+**********************************************************************/
+func (this *Forwarder) Links() ([]LinkStats) {
+    this.mutex.Lock()
+    defer this.mutex.Unlock()
+    links := make([]LinkStats, 0, len(this.links))
+    for _, l := range this.links {
+        links = append(links, l.stats.snapshot())
+    }
+    sort.Slice(links, func(i, j int) (bool) {
+        return links[i].Id < links[j].Id
+    })
+    return links
+}
+
+
+/**********************************************************************
+* @Function: (this *Forwarder) CloseLink(id int) (bool)
+* @Description: close an active link
+* @Parameter: id int, the link id
+* @Return: bool, false if the link is not found
+**********************************************************************/
+func (this *Forwarder) CloseLink(id int) (bool) {
+    this.mutex.Lock()
+    defer this.mutex.Unlock()
+    l, ok := this.links[id]
+    if !ok {
+        return false
+    }
+    l.reason = "closed by admin"
+    l.sock1.Close()
+    l.sock2.Close()
+    return true
+}
+
+
+/**********************************************************************
+* @Function: (this *Forwarder) activeLinks() (int)
+* @Description: get the number of active links
+* @Parameter: nil
+* @Return: int, the number of active links
+**********************************************************************/
+func (this *Forwarder) activeLinks() (int) {
+    this.mutex.Lock()
+    defer this.mutex.Unlock()
+    return len(this.links)
+}
+
+
+/**********************************************************************
+* @Function: (this *Forwarder) closeLinks()
+* @Description: close all of the active links, so that "ConnectSock()"
+*   can exit, and the later links are rejected
+* @Parameter: nil
+* @Return: nil
+**********************************************************************/
+func (this *Forwarder) closeLinks() {
+    this.mutex.Lock()
+    defer this.mutex.Unlock()
+    this.forced = true
+    for _, l := range this.links {
+        l.sock1.Close()
+        l.sock2.Close()
+    }
+}
+
+
+/**********************************************************************
+* @Function: (this *Forwarder) sleep(d time.Duration) (bool)
+* @Description: sleep a while, and wake up when forwarder is stopped
+* @Parameter: d time.Duration, the sleep duration
+* @Return: bool, false if the forwarder is stopped
+**********************************************************************/
+func (this *Forwarder) sleep(d time.Duration) (bool) {
+    select {
+    case <-this.ctx.Done():
+        return false
+    case <-time.After(d):
+        return true
+    }
+}
+
+
+/**********************************************************************
+* @Function: (this *Forwarder) listenConn(listen ListenFunc, addr1 string,
+*   target TargetFunc)
+* @Description: "Listen<=>Conn" working mode, the B point socket of each
+*   link is got concurrently, so that a slow link does not block accepting
+* @Parameter: listen ListenFunc, the launch function of listen sock
+* @Parameter: addr1 string, the address1 "ip:port" string
+* @Parameter: target TargetFunc, the function to get the B point socket
+* @Return: nil
+**********************************************************************/
+func (this *Forwarder) listenConn(listen ListenFunc, addr1 string,
+    target TargetFunc) {
+    // launch socket1 listen
+    clientc := make(chan Conn)
+    this.logger.Info("listen A point with sock1 [%s]", addr1)
+    this.goroutine(func() {
+        listen(this.ctx, addr1, clientc, this.logger)
+    })
+
+    for {
+        // socket1 listen & quit signal
+        var sock1 Conn = nil
+        select {
+        case <-this.ctx.Done():
+            return
+        case sock1 = <-clientc:
+            if sock1 == nil {
+                // the listener has exited when error happend
+                return
+            }
+        }
+        id := this.nextId()
+        this.linkLogger(id, sock1).Info("A point(link%d) [%s] is ready", id,
+                                        sock1.RemoteAddr())
+
+        // socket2 dial
+        this.goroutine(func() {
+            sock2, err := target(sock1)
+            if err != nil {
+                sock1.Close()
+                WithFields(this.logger, Field{"link", id},
+                           Field{"error", err}).Error("%s", err)
+                return
+            }
+            this.linkLogger(id, sock2).Info("B point(link%d) [%s] is ready", id,
+                                            sock2.RemoteAddr())
+
+            // connect with sockets
+            this.connect(id, sock1, sock2)
+        })
+    } // end for
+}
+
+
+/**********************************************************************
+* @Function: (this *Forwarder) listenListen(listen1 ListenFunc, addr1 string,
+*   listen2 ListenFunc, addr2 string)
+* @Description: the "Listen<=>Listen" working mode
+* @Parameter: listen1 ListenFunc, the launch function of listen sock1
+* @Parameter: addr1 string, the address1 "ip:port" string
+* @Parameter: listen2 ListenFunc, the launch function of listen sock2
+* @Parameter: addr2 string, the address2 "ip:port" string
+* @Return: nil
+**********************************************************************/
+func (this *Forwarder) listenListen(listen1 ListenFunc, addr1 string,
+    listen2 ListenFunc, addr2 string) {
+    // the listeners exit together when either of them exited
+    ctx, cancel := context.WithCancel(this.ctx)
+    defer cancel()
+
+    // launch socket1 listen
+    clientc1 := make(chan Conn)
+    this.logger.Info("listen A point with sock1 [%s]", addr1)
+    this.goroutine(func() {
+        listen1(ctx, addr1, clientc1, this.logger)
+    })
+    // launch socket2 listen
+    clientc2 := make(chan Conn)
+    this.logger.Info("listen B point with sock2 [%s]", addr2)
+    this.goroutine(func() {
+        listen2(ctx, addr2, clientc2, this.logger)
+    })
+
+    // the pending sockets of each end, the oldest one is closed when the
+    // number of pending sockets exceeds the pool size
+    pool := this.poolSize()
+    pairing := this.timeouts.Pairing
+    pending1 := make([]Conn, 0, pool + 1)
+    pending2 := make([]Conn, 0, pool + 1)
+    release := func() {
+        for _, s := range pending1 {
+            s.Close()
+        }
+        for _, s := range pending2 {
+            s.Close()
+        }
+        pending1 = pending1[:0]
+        pending2 = pending2[:0]
+    }
+    for {
+        select {
+        case <-this.ctx.Done():
+            release()
+            return
+        case c1 := <-clientc1:
+            if c1 == nil {
+                // the listener has exited when error happend, exit this
+                // rule, and the other listener exits by "cancel()"
+                release()
+                return
+            }
+            // close the oldest pending sock1
+            pending1 = append(pending1, c1)
+            if len(pending1) > pool {
+                pending1[0].Close()
+                pending1 = pending1[1:]
+            }
+            this.logger.Info("A point [%s] is ready", c1.RemoteAddr())
+        case c2 := <-clientc2:
+            if c2 == nil {
+                // the listener has exited when error happend, exit this
+                // rule, and the other listener exits by "cancel()"
+                release()
+                return
+            }
+            // close the oldest pending sock2
+            pending2 = append(pending2, c2)
+            if len(pending2) > pool {
+                pending2[0].Close()
+                pending2 = pending2[1:]
+            }
+            this.logger.Info("B point [%s] is ready", c2.RemoteAddr())
+        case <-time.After(pairing):
+            atomic.AddInt64(&this.stats.PairingTimeouts,
+                            int64(len(pending1) + len(pending2)))
+            for _, s := range pending1 {
+                this.logger.Warn("A point(%s) socket wait timeout, reset", s.RemoteAddr())
+            }
+            for _, s := range pending2 {
+                this.logger.Warn("B point(%s) socket wait timeout, reset", s.RemoteAddr())
+            }
+            release()
+            continue
+        }
+
+        // the two socket is ready, connect with sockets in order
+        for len(pending1) > 0 && len(pending2) > 0 {
+            sock1, sock2 := pending1[0], pending2[0]
+            pending1, pending2 = pending1[1:], pending2[1:]
+            id := this.nextId()
+            this.linkLogger(id, sock1).Info("A point(link%d) [%s] and B point " +
+                                            "[%s] are paired", id,
+                                            sock1.RemoteAddr(), sock2.RemoteAddr())
+            this.connect(id, sock1, sock2)
+        }
+    } // end for
+}
+
+
+/**********************************************************************
+* @Function: (this *Forwarder) connConn(dial DialFunc, addr1 string,
+*   target TargetFunc)
+* @Description: the "Conn<=>Conn" working mode, a pool of A point sockets
+*   is kept, each of them waits for the first message concurrently
+* @Parameter: dial DialFunc, the launch function of conn sock1
+* @Parameter: addr1 string, the address1 "ip:port" string
+* @Parameter: target TargetFunc, the function to get the B point socket
+* @Return: nil
+**********************************************************************/
+func (this *Forwarder) connConn(dial DialFunc, addr1 string,
+    target TargetFunc) {
+    for i := 0; i < this.poolSize(); i++ {
+        this.goroutine(func() {
+            this.connIdle(dial, addr1, target)
+        })
+    }
+}
+
+
+/**********************************************************************
+* @Function: (this *Forwarder) connIdle(dial DialFunc, addr1 string,
+*   target TargetFunc)
+* @Description: keep an idle A point socket of pool, when the first message
+*   is received, the B point socket is got in background and a new A point
+*   socket is dialed to replenish the pool. The failures are retried by the
+*   retry policy, it gives up after the max attempts
+* @Parameter: dial DialFunc, the launch function of conn sock1
+* @Parameter: addr1 string, the address1 "ip:port" string
+* @Parameter: target TargetFunc, the function to get the B point socket
+* @Return: nil
+**********************************************************************/
+func (this *Forwarder) connIdle(dial DialFunc, addr1 string,
+    target TargetFunc) {
+    retry := newBackoff(this.args.Retry)
+    // wait before retry, false if it should give up
+    failed := func() (bool) {
+        if retry.Exhausted() {
+            this.logger.Error("A point [%s] give up after %d retries",
+                              addr1, retry.attempts)
+            return false
+        }
+        delay := retry.Next()
+        this.logger.Info("retry(%d) A point in %s", retry.attempts,
+                         delay.Round(time.Millisecond))
+        return this.sleep(delay)
+    }
+
+    for {
+        select {
+        case <-this.ctx.Done():
+            return
+        default:
+        }
+
+        // socket1 dial
+        this.logger.Info("dial A point with sock1 [%s]", addr1)
+        sock1, err := dial(addr1)
+        if err != nil {
+            this.logger.Error("%s", err)
+            if !failed() {
+                return
+            }
+            continue
+        }
+        this.logger.Info("A point(sock1) is ready")
+
+        // waiting for the first message sent by the A point(sock1), the
+        // sock1 is closed when forwarder is stopped so that "Read" can exit
+        wait := make(chan bool)
+        this.goroutine(func() {
+            select {
+            case <-this.ctx.Done():
+                sock1.Close()
+            case <-wait:
+            }
+        })
+        buf := make([]byte, 32 * 1024)
+        n, err := sock1.Read(buf)
+        close(wait)
+        if err != nil {
+            sock1.Close()
+            if this.ctx.Err() != nil {
+                return
+            }
+            this.logger.Error("A point: %s", err)
+            if !failed() {
+                return
+            }
+            continue
+        }
+        retry.Reset()
+        // the first message is read again from sock1, it is passed in
+        // the B point socket by "ConnectSock()"
+        sock1 = &prefixConn{Conn: sock1, prefix: buf[:n]}
+        id := this.nextId()
+
+        // socket2 dial
+        this.goroutine(func() {
+            sock2, err := target(sock1)
+            if err != nil {
+                sock1.Close()
+                WithFields(this.logger, Field{"link", id},
+                           Field{"error", err}).Error("%s", err)
+                return
+            }
+            this.linkLogger(id, sock2).Info("B point(link%d) [%s] is ready", id,
+                                            sock2.RemoteAddr())
+
+            // connect with sockets
+            this.connect(id, sock1, sock2)
+        })
+    } // end for
+}
+
+
+/**********************************************************************
+* @Function: (this *Forwarder) poolSize() (int)
+* @Description: get the number of idle A point sockets in conn<=>conn mode,
+*   or pending sockets of each end in listen<=>listen mode
+* @Parameter: nil
+* @Return: int, the pool size, at least 1
+**********************************************************************/
+func (this *Forwarder) poolSize() (int) {
+    if this.args.Pool < 1 {
+        return 1
+    }
+    return this.args.Pool
+}
+
+
+/**********************************************************************
+* @Function: ConnectSock(id int, sock1 Conn, sock2 Conn, logger Logger)
+* @Description: connect two sockets with the global default linger timeout
+* @Parameter: id int, the communication link id
+* @Parameter: sock1 Conn, the first socket object
+* @Parameter: sock2 Conn, the second socket object
+* @Parameter: logger Logger, the logger of link
+* @Return: nil
+**********************************************************************/
+func ConnectSock(id int, sock1 Conn, sock2 Conn, logger Logger) {
+    connectSock(id, sock1, sock2, Timeouts{}.withDefaults().Linger, logger)
+}
+
+
+/**********************************************************************
+* @Function: connectSock(id int, sock1 Conn, sock2 Conn,
+*   linger time.Duration, logger Logger)
+* @Description: connect two sockets, if an error occurs, the socket will
+*   be closed so that the coroutine can exit normally, it returns after
+*   both directions have exited.
+*   when one direction reaches EOF, it is propagated by "CloseWrite" (tcp
+*   half-close), and the other direction keeps running until it finishes
+*   or the linger timeout expires; the sockets are closed at once if the
+*   half-close is not supported
+* @Parameter: id int, the communication link id
+* @Parameter: sock1 Conn, the first socket object
+* @Parameter: sock2 Conn, the second socket object
+* @Parameter: linger time.Duration, the linger timeout of half-closed link,
+*   the half-close is disabled if it is not positive
+* @Parameter: logger Logger, the logger of link
+* @Return: nil
+**********************************************************************/
+func connectSock(id int, sock1 Conn, sock2 Conn, linger time.Duration,
+    logger Logger) {
+    // true if the direction finished with half-close
+    exit := make(chan bool, 2)
+
+    relay := func(dst Conn, src Conn, direction string) {
+        n, err := io.Copy(dst, src)
+        logger := WithFields(logger, Field{"direction", direction},
+                             Field{"bytes", n})
+        if err != nil {
+            WithFields(logger, Field{"error", err}).Error("ConnectSock%d(%s): %s",
+                                                          id, direction, err)
+            exit <- false
+            return
+        }
+        // EOF is received, send it to the other end
+        if linger > 0 && closeWrite(dst) == nil {
+            logger.Info("ConnectSock%d(%s) half-closed", id, direction)
+            exit <- true
+            return
+        }
+        logger.Info("ConnectSock%d(%s) exited", id, direction)
+        exit <- false
+    }
+    go relay(sock2, sock1, "A=>B")
+    go relay(sock1, sock2, "B=>A")
+
+    // exit when close either end, unless it is half-closed
+    if <-exit {
+        timer := time.NewTimer(linger)
+        select {
+        case <-exit:
+            timer.Stop()
+            sock1.Close()
+            sock2.Close()
+            return
+        case <-timer.C:
+            logger.Warn("ConnectSock%d half-closed for %s, reset", id, linger)
+        }
+    }
+    // close all socket, so that "io.Copy" can exit
+    sock1.Close()
+    sock2.Close()
+    <-exit
+}
+
+
+// the connection with the data which has been read in advance
+type prefixConn struct {
+    Conn
+    prefix      []byte
+}
+
+
+/**********************************************************************
+* @Function: (this *prefixConn) Read(b []byte) (n int, err error)
+* @Description: read the data which has been read in advance at first
+* @Parameter: b []byte, the buffer for receive data
+* @Return: (n int, err error), the length of the data read and error
+**********************************************************************/
+func (this *prefixConn) Read(b []byte) (n int, err error) {
+    if len(this.prefix) > 0 {
+        n = copy(b, this.prefix)
+        this.prefix = this.prefix[n:]
+        return n, nil
+    }
+    return this.Conn.Read(b)
+}
+
+
+/**********************************************************************
+* @Function: (this *prefixConn) CloseWrite() (error)
+* @Description: shut down the writing side of underlying connection
+* @Parameter: nil
+* @Return: error, the error
+**********************************************************************/
+func (this *prefixConn) CloseWrite() (error) {
+    return closeWrite(this.Conn)
+}
+
+
+/**********************************************************************
+* @Function: (this *prefixConn) SetDeadline(t time.Time) (error)
+* @Description: set the deadline of underlying connection
+* @Parameter: t time.Time, the deadline
+* @Return: error, always nil
+**********************************************************************/
+func (this *prefixConn) SetDeadline(t time.Time) (error) {
+    setDeadline(this.Conn, t)
+    return nil
+}
@@ -0,0 +1,149 @@
+/**
+* Filename: httpproxy.go
+* Description: the PortForward http proxy server, it works as the B point of
+*   link like the socks5 server, the A point socket sends HTTP "CONNECT
+*   host:port" request, and the destination is chosen per link. The optional
+*   Basic authentication is checked by "Proxy-Authorization" header.
+* Author: knownsec404
+* Time: 2020.10.22
+*/
+
+package forward
+
+import (
+    "bufio"
+    "bytes"
+    "crypto/subtle"
+    "encoding/base64"
+    "errors"
+    "fmt"
+    "net"
+    "net/http"
+    "strings"
+    "time"
+)
+
+// the maximum size of request header
+const httpHeaderSize int = 8 * 1024
+
+
+/**********************************************************************
+* @Function: HTTPProxyTarget(auth ProxyAuth, dial DialFunc, logger Logger) (TargetFunc)
+* @Description: get the function which serves http proxy on the A point
+*   socket, and returns the socket of the requested destination as B point
+* @Parameter: auth ProxyAuth, the username/password, empty means no auth
+* @Parameter: dial DialFunc, the function to dial the destination
+* @Parameter: logger Logger, the logger
+* @Return: TargetFunc, the function to get the B point socket
+**********************************************************************/
+func HTTPProxyTarget(auth ProxyAuth, dial DialFunc, logger Logger) (TargetFunc) {
+    return func(sock1 Conn) (Conn, error) {
+        // the request must be received in time
+        setDeadline(sock1, time.Now().Add(10 * time.Second))
+        defer setDeadline(sock1, time.Time{})
+
+        header, err := httpReadHeader(sock1)
+        if err != nil {
+            return nil, fmt.Errorf("http proxy request error, %s", err)
+        }
+        req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(header)))
+        if err != nil {
+            httpReply(sock1, http.StatusBadRequest, "")
+            return nil, fmt.Errorf("http proxy request error, %s", err)
+        }
+
+        if auth.Username != "" && !httpCheckAuth(req, auth) {
+            httpReply(sock1, http.StatusProxyAuthRequired,
+                      "Proxy-Authenticate: Basic realm=\"PortForward\"\r\n")
+            return nil, errors.New("http proxy auth error, " +
+                                   "invalid username or password")
+        }
+        if req.Method != http.MethodConnect {
+            httpReply(sock1, http.StatusMethodNotAllowed, "")
+            return nil, fmt.Errorf("http proxy method [%s] not supported",
+                                   req.Method)
+        }
+
+        // the destination must be "host:port"
+        address := req.Host
+        _, _, err = net.SplitHostPort(address)
+        if err != nil {
+            httpReply(sock1, http.StatusBadRequest, "")
+            return nil, fmt.Errorf("http proxy CONNECT [%s] error, %s",
+                                   address, err)
+        }
+        logger.Info("http proxy CONNECT [%s]", address)
+        sock2, err := dial(address)
+        if err != nil {
+            httpReply(sock1, http.StatusBadGateway, "")
+            return nil, fmt.Errorf("http proxy CONNECT [%s] error, %s",
+                                   address, err)
+        }
+        _, err = sock1.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
+        if err != nil {
+            sock2.Close()
+            return nil, err
+        }
+        return sock2, nil
+    }
+}
+
+
+/**********************************************************************
+* @Function: httpReadHeader(conn Conn) ([]byte, error)
+* @Description: read the request header until the empty line, it reads
+*   byte by byte, so that the data after header is left in the socket
+* @Parameter: conn Conn, the client socket
+* @Return: ([]byte, error), the request header and error
+**********************************************************************/
+func httpReadHeader(conn Conn) ([]byte, error) {
+    header := make([]byte, 0, 512)
+    b := make([]byte, 1)
+    for !bytes.HasSuffix(header, []byte("\r\n\r\n")) &&
+        !bytes.HasSuffix(header, []byte("\n\n")) {
+        if len(header) >= httpHeaderSize {
+            return nil, errors.New("request header too large")
+        }
+        _, err := conn.Read(b)
+        if err != nil {
+            return nil, err
+        }
+        header = append(header, b[0])
+    }
+    return header, nil
+}
+
+
+/**********************************************************************
+* @Function: httpCheckAuth(req *http.Request, auth ProxyAuth) (bool)
+* @Description: check the Basic authentication of "Proxy-Authorization"
+* @Parameter: req *http.Request, the proxy request
+* @Parameter: auth ProxyAuth, the username/password
+* @Return: bool, true if the username/password is correct
+**********************************************************************/
+func httpCheckAuth(req *http.Request, auth ProxyAuth) (bool) {
+    items := strings.SplitN(req.Header.Get("Proxy-Authorization"), " ", 2)
+    if len(items) != 2 || !strings.EqualFold(items[0], "Basic") {
+        return false
+    }
+    data, err := base64.StdEncoding.DecodeString(strings.TrimSpace(items[1]))
+    if err != nil {
+        return false
+    }
+    expect := []byte(auth.Username + ":" + auth.Password)
+    return subtle.ConstantTimeCompare(data, expect) == 1
+}
+
+
+/**********************************************************************
+* @Function: httpReply(conn Conn, code int, header string)
+* @Description: send the error response, the connection is closed by caller
+* @Parameter: conn Conn, the client socket
+* @Parameter: code int, the status code
+* @Parameter: header string, the extra header lines
+* @Return: nil
+**********************************************************************/
+func httpReply(conn Conn, code int, header string) {
+    fmt.Fprintf(conn, "HTTP/1.1 %d %s\r\n%sContent-Length: 0\r\n" +
+                "Connection: close\r\n\r\n", code, http.StatusText(code), header)
+}
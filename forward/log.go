@@ -0,0 +1,515 @@
+/**
+* Filename: log.go
+* Description: the log information format, the log line is formatted as
+*   text or json, and written to the sinks in logsink.go
+* Author: knownsec404
+* Time: 2020.08.17
+*/
+
+package forward
+
+import (
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+
+const (
+    LOG_LEVEL_NONE  uint32 = 0
+    LOG_LEVEL_FATAL uint32 = 1
+    LOG_LEVEL_ERROR uint32 = 2
+    LOG_LEVEL_WARN  uint32 = 3
+    LOG_LEVEL_INFO  uint32 = 4
+    LOG_LEVEL_DEBUG uint32 = 5
+)
+
+// the log level, it is read and written atomically, so that it can be
+// changed at runtime by "SetLogLevel()"
+var LOG_LEVEL uint32 = LOG_LEVEL_DEBUG
+
+// the names of log level
+var logLevelNames = []string{"none", "fatal", "error", "warn", "info", "debug"}
+
+// the PortForward logger interface, it can be injected into "Forwarder"
+type Logger interface {
+    // Error logs infomations with error level.
+    Error(format string, a ...interface{})
+    // Warn logs infomations with warn level.
+    Warn(format string, a ...interface{})
+    // Info logs infomations with info level.
+    Info(format string, a ...interface{})
+    // Debug logs infomations with debug level.
+    Debug(format string, a ...interface{})
+}
+
+// the logger which carries structured fields, the fields are dropped by
+// "WithFields()" if the injected logger does not implement it
+type FieldLogger interface {
+    Logger
+    // With returns the logger which adds fields to each log line.
+    With(fields ...Field) (Logger)
+}
+
+// the logger whose log level can be overridden, such as the rule with
+// its own log level
+type LevelLogger interface {
+    Logger
+    // WithLevel returns the logger with the log level.
+    WithLevel(level uint32) (Logger)
+}
+
+// the structured field of log line, such as "rule", "link", "local",
+// "remote", "direction", "bytes" and "error"
+type Field struct {
+    Key         string
+    Value       interface{}
+}
+
+// the log line passed to formatter and sinks
+type LogEntry struct {
+    Time        time.Time
+    Level       uint32
+    Message     string
+    Fields      []Field
+}
+
+// the formatter of log line
+type LogFormatter interface {
+    // Format returns the log line, with the trailing newline.
+    Format(entry *LogEntry) ([]byte)
+}
+
+// the text formatter, "[01-02|15:04:05] [LEVEL] [rule] message"
+type TextFormatter struct {}
+
+// the json formatter, one json object per line with the fields
+type JSONFormatter struct {}
+
+// the log output, the formatter and sinks are replaced at runtime
+var logOutput = struct {
+    sync.Mutex
+    formatter   LogFormatter
+    sinks       []LogSink
+}{formatter: TextFormatter{}, sinks: []LogSink{stdoutSink}}
+
+// the default logger, print to the log sinks, it is the logger of "LogX"
+// functions
+type StdLogger struct {
+    fields      []Field
+    // the log level overrides the global one, nil means the global one
+    level       *uint32
+}
+
+func (this StdLogger) Error(format string, a ...interface{}) {
+    this.output(LOG_LEVEL_ERROR, format, a...)
+}
+func (this StdLogger) Warn(format string, a ...interface{}) {
+    this.output(LOG_LEVEL_WARN, format, a...)
+}
+func (this StdLogger) Info(format string, a ...interface{}) {
+    this.output(LOG_LEVEL_INFO, format, a...)
+}
+func (this StdLogger) Debug(format string, a ...interface{}) {
+    this.output(LOG_LEVEL_DEBUG, format, a...)
+}
+
+
+/**********************************************************************
+* @Function: (this StdLogger) With(fields ...Field) (Logger)
+* @Description: get the logger which adds fields to each log line
+* @Parameter: fields ...Field, the fields
+* @Return: Logger, the logger with fields
+**********************************************************************/
+func (this StdLogger) With(fields ...Field) (Logger) {
+    all := make([]Field, 0, len(this.fields) + len(fields))
+    this.fields = append(append(all, this.fields...), fields...)
+    return this
+}
+
+
+/**********************************************************************
+* @Function: (this StdLogger) WithLevel(level uint32) (Logger)
+* @Description: get the logger whose log level overrides the global one
+* @Parameter: level uint32, the log level
+* @Return: Logger, the logger with log level
+**********************************************************************/
+func (this StdLogger) WithLevel(level uint32) (Logger) {
+    this.level = &level
+    return this
+}
+
+
+/**********************************************************************
+* @Function: (this StdLogger) Enabled(level uint32) (bool)
+* @Description: check whether the log line of level is written
+* @Parameter: level uint32, the log level of line
+* @Return: bool, true if it is written
+**********************************************************************/
+func (this StdLogger) Enabled(level uint32) (bool) {
+    current := GetLogLevel()
+    if this.level != nil {
+        current = *this.level
+    }
+    return level != LOG_LEVEL_NONE && level <= current
+}
+
+
+/**********************************************************************
+* @Function: (this StdLogger) output(level uint32, format string,
+*   a ...interface{})
+* @Description: format the log line and write it to the log sinks, if the
+*   log level is enabled
+* @Parameter: level uint32, the log level
+* @Parameter: format string, the format string template
+* @Parameter: a ...interface{}, the value
+* @Return: nil
+**********************************************************************/
+func (this StdLogger) output(level uint32, format string, a ...interface{}) {
+    if !this.Enabled(level) {
+        return
+    }
+    entry := &LogEntry{
+        Time:       time.Now(),
+        Level:      level,
+        Message:    fmt.Sprintf(format, a...),
+        Fields:     this.fields,
+    }
+
+    logOutput.Lock()
+    defer logOutput.Unlock()
+    line := logOutput.formatter.Format(entry)
+    for _, sink := range logOutput.sinks {
+        sink.WriteLog(level, line)
+    }
+}
+
+// the logger which adds rule name before each log line
+type RuleLogger struct {
+    Logger      Logger
+    Name        string
+}
+
+
+/**********************************************************************
+* @Function: NewRuleLogger(logger Logger, name string) (Logger)
+* @Description: wrap logger with rule name, return the logger itself if
+*   the name is empty. the rule name is the field "rule" if the logger
+*   implements "FieldLogger"
+* @Parameter: logger Logger, the wrapped logger
+* @Parameter: name string, the rule name
+* @Return: Logger, the logger with rule name
+**********************************************************************/
+func NewRuleLogger(logger Logger, name string) (Logger) {
+    if name == "" {
+        return logger
+    }
+    if l, ok := logger.(FieldLogger); ok {
+        return l.With(Field{"rule", name})
+    }
+    return &RuleLogger{Logger: logger, Name: name}
+}
+
+func (this *RuleLogger) Error(format string, a ...interface{}) {
+    this.Logger.Error("[%s] %s", this.Name, fmt.Sprintf(format, a...))
+}
+func (this *RuleLogger) Warn(format string, a ...interface{}) {
+    this.Logger.Warn("[%s] %s", this.Name, fmt.Sprintf(format, a...))
+}
+func (this *RuleLogger) Info(format string, a ...interface{}) {
+    this.Logger.Info("[%s] %s", this.Name, fmt.Sprintf(format, a...))
+}
+func (this *RuleLogger) Debug(format string, a ...interface{}) {
+    this.Logger.Debug("[%s] %s", this.Name, fmt.Sprintf(format, a...))
+}
+
+
+/**********************************************************************
+* @Function: WithLogLevel(logger Logger, name string) (Logger)
+* @Description: get the logger whose log level overrides the global one,
+*   the level is ignored if the logger does not implement "LevelLogger"
+* @Parameter: logger Logger, the logger
+* @Parameter: name string, the name of log level, empty means the global
+*   log level
+* @Return: Logger, the logger with log level
+**********************************************************************/
+func WithLogLevel(logger Logger, name string) (Logger) {
+    if name == "" {
+        return logger
+    }
+    level, err := ParseLogLevel(name)
+    if err != nil {
+        return logger
+    }
+    if l, ok := logger.(LevelLogger); ok {
+        return l.WithLevel(level)
+    }
+    return logger
+}
+
+
+/**********************************************************************
+* @Function: WithFields(logger Logger, fields ...Field) (Logger)
+* @Description: get the logger which adds fields to each log line, the
+*   fields are dropped if the logger does not implement "FieldLogger"
+* @Parameter: logger Logger, the logger
+* @Parameter: fields ...Field, the fields
+* @Return: Logger, the logger with fields
+**********************************************************************/
+func WithFields(logger Logger, fields ...Field) (Logger) {
+    if l, ok := logger.(FieldLogger); ok {
+        return l.With(fields...)
+    }
+    return logger
+}
+
+
+/**********************************************************************
+* @Function: (TextFormatter) Format(entry *LogEntry) ([]byte)
+* @Description: format the log line as text, the field "rule" is added
+*   before message, the other fields are omitted since the message has
+*   carried them
+* @Parameter: entry *LogEntry, the log line
+* @Return: []byte, the formatted log line
+**********************************************************************/
+func (TextFormatter) Format(entry *LogEntry) ([]byte) {
+    var b strings.Builder
+    fmt.Fprintf(&b, "[%s] [%s] ", entry.Time.Format("01-02|15:04:05"),
+                strings.ToUpper(LogLevelName(entry.Level)))
+    for _, field := range entry.Fields {
+        if field.Key == "rule" {
+            fmt.Fprintf(&b, "[%v] ", field.Value)
+        }
+    }
+    b.WriteString(entry.Message)
+    b.WriteString("\n")
+    return []byte(b.String())
+}
+
+
+/**********************************************************************
+* @Function: (JSONFormatter) Format(entry *LogEntry) ([]byte)
+* @Description: format the log line as json object, such as
+*   {"time":"...","level":"info","msg":"...","rule":"rdp","link":1}
+* @Parameter: entry *LogEntry, the log line
+* @Return: []byte, the formatted log line
+**********************************************************************/
+func (JSONFormatter) Format(entry *LogEntry) ([]byte) {
+    var b bytes.Buffer
+    b.WriteString("{\"time\":")
+    writeJSON(&b, entry.Time.Format(time.RFC3339Nano))
+    b.WriteString(",\"level\":")
+    writeJSON(&b, LogLevelName(entry.Level))
+    b.WriteString(",\"msg\":")
+    writeJSON(&b, entry.Message)
+    for _, field := range entry.Fields {
+        b.WriteString(",")
+        writeJSON(&b, field.Key)
+        b.WriteString(":")
+        switch v := field.Value.(type) {
+        case error:
+            writeJSON(&b, v.Error())
+        case fmt.Stringer:
+            writeJSON(&b, v.String())
+        default:
+            writeJSON(&b, v)
+        }
+    }
+    b.WriteString("}\n")
+    return b.Bytes()
+}
+
+
+/**********************************************************************
+* @Function: writeJSON(b *bytes.Buffer, value interface{})
+* @Description: write the json value without html escaping, such as "=>",
+*   the value which can not be encoded is written as string
+* @Parameter: b *bytes.Buffer, the buffer
+* @Parameter: value interface{}, the value
+* @Return: nil
+**********************************************************************/
+func writeJSON(b *bytes.Buffer, value interface{}) {
+    var data bytes.Buffer
+    encoder := json.NewEncoder(&data)
+    encoder.SetEscapeHTML(false)
+    if encoder.Encode(value) != nil {
+        data.Reset()
+        encoder.Encode(fmt.Sprint(value))
+    }
+    // the encoder appends newline
+    b.Write(bytes.TrimRight(data.Bytes(), "\n"))
+}
+
+
+/**********************************************************************
+* @Function: ParseLogFormatter(name string) (LogFormatter, error)
+* @Description: parse the name of log formatter, "text" or "json"
+* @Parameter: name string, the name of log formatter
+* @Return: (LogFormatter, error), the log formatter and error
+**********************************************************************/
+func ParseLogFormatter(name string) (LogFormatter, error) {
+    switch strings.ToLower(name) {
+    case "text":
+        return TextFormatter{}, nil
+    case "json":
+        return JSONFormatter{}, nil
+    }
+    return nil, fmt.Errorf("unknown log format [%s]", name)
+}
+
+
+/**********************************************************************
+* @Function: SetLogOutput(formatter LogFormatter, sinks ...LogSink)
+* @Description: set the log formatter and sinks, the previous sinks are
+*   closed
+* @Parameter: formatter LogFormatter, the log formatter
+* @Parameter: sinks ...LogSink, the log sinks
+* @Return: nil
+**********************************************************************/
+func SetLogOutput(formatter LogFormatter, sinks ...LogSink) {
+    logOutput.Lock()
+    defer logOutput.Unlock()
+    for _, sink := range logOutput.sinks {
+        sink.Close()
+    }
+    logOutput.formatter = formatter
+    logOutput.sinks = sinks
+}
+
+
+/**********************************************************************
+* @Function: ReopenLogOutput() (error)
+* @Description: reopen the log files, it is called after the external
+*   logrotate moved them
+* @Parameter: nil
+* @Return: error, the last error of reopening
+**********************************************************************/
+func ReopenLogOutput() (error) {
+    logOutput.Lock()
+    defer logOutput.Unlock()
+    var err error
+    for _, sink := range logOutput.sinks {
+        if file, ok := sink.(*LogFile); ok {
+            if e := file.Reopen(); e != nil {
+                err = e
+            }
+        }
+    }
+    return err
+}
+
+
+/**********************************************************************
+* @Function: GetLogLevel() (uint32)
+* @Description: get the log level
+* @Parameter: nil
+* @Return: uint32, the log level
+**********************************************************************/
+func GetLogLevel() (uint32) {
+    return atomic.LoadUint32(&LOG_LEVEL)
+}
+
+
+/**********************************************************************
+* @Function: SetLogLevel(level uint32)
+* @Description: set the log level, it is safe to call at runtime
+* @Parameter: level uint32, the log level
+* @Return: nil
+**********************************************************************/
+func SetLogLevel(level uint32) {
+    atomic.StoreUint32(&LOG_LEVEL, level)
+}
+
+
+/**********************************************************************
+* @Function: ParseLogLevel(name string) (uint32, error)
+* @Description: parse the name of log level, such as "info"
+* @Parameter: name string, the name of log level
+* @Return: (uint32, error), the log level and error
+**********************************************************************/
+func ParseLogLevel(name string) (uint32, error) {
+    for level, n := range logLevelNames {
+        if strings.EqualFold(name, n) {
+            return uint32(level), nil
+        }
+    }
+    return LOG_LEVEL_NONE, fmt.Errorf("unknown log level [%s]", name)
+}
+
+
+/**********************************************************************
+* @Function: LogLevelName(level uint32) (string)
+* @Description: get the name of log level
+* @Parameter: level uint32, the log level
+* @Return: string, the name of log level
+**********************************************************************/
+func LogLevelName(level uint32) (string) {
+    if int(level) >= len(logLevelNames) {
+        return logLevelNames[LOG_LEVEL_DEBUG]
+    }
+    return logLevelNames[level]
+}
+
+
+/**********************************************************************
+* @Function: LogFatal(format string, a ...interface{})
+* @Description: log infomations with fatal level
+* @Parameter: format string, the format string template
+* @Parameter: a ...interface{}, the value
+* @Return: nil
+**********************************************************************/
+func LogFatal(format string, a ...interface{}) {
+    StdLogger{}.output(LOG_LEVEL_FATAL, format, a...)
+}
+
+
+/**********************************************************************
+* @Function: LogError(format string, a ...interface{})
+* @Description: log infomations with error level
+* @Parameter: format string, the format string template
+* @Parameter: a ...interface{}, the value
+* @Return: nil
+**********************************************************************/
+func LogError(format string, a ...interface{}) {
+    StdLogger{}.Error(format, a...)
+}
+
+
+/**********************************************************************
+* @Function: LogWarn(format string, a ...interface{})
+* @Description: log infomations with warn level
+* @Parameter: format string, the format string template
+* @Parameter: a ...interface{}, the value
+* @Return: nil
+**********************************************************************/
+func LogWarn(format string, a ...interface{}) {
+    StdLogger{}.Warn(format, a...)
+}
+
+
+/**********************************************************************
+* @Function: LogInfo(format string, a ...interface{})
+* @Description: log infomations with info level
+* @Parameter: format string, the format string template
+* @Parameter: a ...interface{}, the value
+* @Return: nil
+**********************************************************************/
+func LogInfo(format string, a ...interface{}) {
+    StdLogger{}.Info(format, a...)
+}
+
+
+/**********************************************************************
+* @Function: LogDebug(format string, a ...interface{})
+* @Description: log infomations with debug level
+* @Parameter: format string, the format string template
+* @Parameter: a ...interface{}, the value
+* @Return: nil
+**********************************************************************/
+func LogDebug(format string, a ...interface{}) {
+    StdLogger{}.Debug(format, a...)
+}
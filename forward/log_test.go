@@ -0,0 +1,212 @@
+/**
+* Filename: log_test.go
+* Description: the unit tests of log level checks
+* Author: knownsec404
+* Time: 2020.10.23
+*/
+
+package forward
+
+import (
+    "encoding/json"
+    "strings"
+    "testing"
+)
+
+// the sink which records the log lines
+type testSink struct {
+    levels      []uint32
+    lines       []string
+}
+
+func (this *testSink) WriteLog(level uint32, line []byte) (error) {
+    this.levels = append(this.levels, level)
+    this.lines = append(this.lines, string(line))
+    return nil
+}
+
+func (this *testSink) Close() (error) { return nil }
+
+func (this *testSink) reset() {
+    this.levels, this.lines = nil, nil
+}
+
+
+/**********************************************************************
+* @Function: captureLog(t *testing.T, formatter LogFormatter) (*testSink)
+* @Description: write the log lines to a test sink until the test ends,
+*   the global log level and output are restored after the test
+* @Parameter: t *testing.T, the test
+* @Parameter: formatter LogFormatter, the log formatter
+* @Return: *testSink, the test sink
+**********************************************************************/
+func captureLog(t *testing.T, formatter LogFormatter) (*testSink) {
+    level := GetLogLevel()
+    sink := &testSink{}
+    SetLogOutput(formatter, sink)
+    t.Cleanup(func() {
+        SetLogLevel(level)
+        SetLogOutput(TextFormatter{}, stdoutSink)
+    })
+    return sink
+}
+
+// the log functions and their levels
+var logFuncs = []struct {
+    name        string
+    level       uint32
+    log         func(format string, a ...interface{})
+}{
+    {"LogFatal", LOG_LEVEL_FATAL, LogFatal},
+    {"LogError", LOG_LEVEL_ERROR, LogError},
+    {"LogWarn", LOG_LEVEL_WARN, LogWarn},
+    {"LogInfo", LOG_LEVEL_INFO, LogInfo},
+    {"LogDebug", LOG_LEVEL_DEBUG, LogDebug},
+}
+
+// the log methods of "StdLogger" and their levels
+var loggerFuncs = []struct {
+    name        string
+    level       uint32
+    log         func(logger Logger, format string, a ...interface{})
+}{
+    {"Error", LOG_LEVEL_ERROR, Logger.Error},
+    {"Warn", LOG_LEVEL_WARN, Logger.Warn},
+    {"Info", LOG_LEVEL_INFO, Logger.Info},
+    {"Debug", LOG_LEVEL_DEBUG, Logger.Debug},
+}
+
+
+func TestLogFuncLevels(t *testing.T) {
+    sink := captureLog(t, TextFormatter{})
+    for _, f := range logFuncs {
+        for level := LOG_LEVEL_NONE; level <= LOG_LEVEL_DEBUG; level++ {
+            SetLogLevel(level)
+            sink.reset()
+            f.log("hello %d", 1)
+
+            want := level != LOG_LEVEL_NONE && f.level <= level
+            if got := len(sink.lines) == 1; got != want {
+                t.Errorf("%s at level %s: written %v, want %v", f.name,
+                         LogLevelName(level), got, want)
+                continue
+            }
+            if !want {
+                continue
+            }
+            tag := "[" + strings.ToUpper(LogLevelName(f.level)) + "] hello 1\n"
+            if !strings.HasSuffix(sink.lines[0], tag) {
+                t.Errorf("%s at level %s: line %q, want suffix %q", f.name,
+                         LogLevelName(level), sink.lines[0], tag)
+            }
+            if sink.levels[0] != f.level {
+                t.Errorf("%s: sink level %d, want %d", f.name, sink.levels[0],
+                         f.level)
+            }
+        }
+    }
+}
+
+
+func TestStdLoggerLevels(t *testing.T) {
+    sink := captureLog(t, TextFormatter{})
+    for _, f := range loggerFuncs {
+        for level := LOG_LEVEL_NONE; level <= LOG_LEVEL_DEBUG; level++ {
+            SetLogLevel(level)
+            sink.reset()
+            f.log(StdLogger{}, "hello")
+
+            want := level != LOG_LEVEL_NONE && f.level <= level
+            if got := len(sink.lines) == 1; got != want {
+                t.Errorf("StdLogger.%s at level %s: written %v, want %v",
+                         f.name, LogLevelName(level), got, want)
+            }
+        }
+    }
+}
+
+
+func TestLogLevelOverride(t *testing.T) {
+    sink := captureLog(t, TextFormatter{})
+    tests := []struct {
+        global      uint32
+        override    string
+        level       uint32
+        want        bool
+    }{
+        {LOG_LEVEL_INFO, "debug", LOG_LEVEL_DEBUG, true},
+        {LOG_LEVEL_INFO, "", LOG_LEVEL_DEBUG, false},
+        {LOG_LEVEL_DEBUG, "error", LOG_LEVEL_INFO, false},
+        {LOG_LEVEL_DEBUG, "error", LOG_LEVEL_ERROR, true},
+        {LOG_LEVEL_DEBUG, "none", LOG_LEVEL_ERROR, false},
+        {LOG_LEVEL_NONE, "warn", LOG_LEVEL_WARN, true},
+        // the invalid level is ignored
+        {LOG_LEVEL_INFO, "verbose", LOG_LEVEL_DEBUG, false},
+    }
+    for _, test := range tests {
+        SetLogLevel(test.global)
+        logger := WithLogLevel(NewRuleLogger(StdLogger{}, "rdp"), test.override)
+        for _, f := range loggerFuncs {
+            if f.level != test.level {
+                continue
+            }
+            sink.reset()
+            f.log(logger, "hello")
+            if got := len(sink.lines) == 1; got != test.want {
+                t.Errorf("global %s, override %q, %s: written %v, want %v",
+                         LogLevelName(test.global), test.override, f.name, got,
+                         test.want)
+            }
+        }
+    }
+
+    // the override does not change the global level
+    SetLogLevel(LOG_LEVEL_INFO)
+    WithLogLevel(StdLogger{}, "debug")
+    sink.reset()
+    LogDebug("hello")
+    if len(sink.lines) != 0 {
+        t.Errorf("LogDebug is written after overriding a logger")
+    }
+}
+
+
+func TestParseLogLevel(t *testing.T) {
+    for level := LOG_LEVEL_NONE; level <= LOG_LEVEL_DEBUG; level++ {
+        name := LogLevelName(level)
+        for _, n := range []string{name, strings.ToUpper(name)} {
+            got, err := ParseLogLevel(n)
+            if err != nil || got != level {
+                t.Errorf("ParseLogLevel(%q) = %d, %v, want %d", n, got, err,
+                         level)
+            }
+        }
+    }
+    if _, err := ParseLogLevel("verbose"); err == nil {
+        t.Errorf("ParseLogLevel(\"verbose\") returns no error")
+    }
+}
+
+
+func TestLogFormatters(t *testing.T) {
+    sink := captureLog(t, TextFormatter{})
+    SetLogLevel(LOG_LEVEL_INFO)
+    logger := WithFields(NewRuleLogger(StdLogger{}, "rdp"), Field{"link", 3})
+    logger.Info("link%d ready", 3)
+    if len(sink.lines) != 1 ||
+       !strings.HasSuffix(sink.lines[0], "[INFO] [rdp] link3 ready\n") {
+        t.Errorf("text line %q", sink.lines)
+    }
+
+    SetLogOutput(JSONFormatter{}, sink)
+    sink.reset()
+    logger.Info("A=>B")
+    var line map[string]interface{}
+    if len(sink.lines) != 1 || json.Unmarshal([]byte(sink.lines[0]), &line) != nil {
+        t.Fatalf("json line %q", sink.lines)
+    }
+    if line["level"] != "info" || line["msg"] != "A=>B" ||
+       line["rule"] != "rdp" || line["link"] != float64(3) {
+        t.Errorf("json line %v", line)
+    }
+}
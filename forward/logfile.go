@@ -0,0 +1,295 @@
+/**
+* Filename: logfile.go
+* Description: the log file sink with rotation, the file is rotated when
+*   its size or age exceeds the limit, the rotated file is renamed with
+*   timestamp such as "pf.log.20201023-150405", compressed optionally, and
+*   the oldest rotated files are removed beyond the retained count. the
+*   empty file is never rotated. the file can be reopened after it is moved
+*   by the external logrotate.
+* Author: knownsec404
+* Time: 2020.10.23
+*/
+
+package forward
+
+import (
+    "compress/gzip"
+    "fmt"
+    "io"
+    "os"
+    "path/filepath"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+)
+
+// the timestamp suffix of rotated file
+const LOG_ROTATE_LAYOUT string = "20060102-150405"
+
+// the rotation options of log file
+type LogFileOptions struct {
+    // rotate the file when its size exceeds it in bytes, 0 means never
+    MaxSize     int64
+    // rotate the file at every interval, such as 24h, 0 means never
+    Interval    time.Duration
+    // the maximum number of retained rotated files, 0 means keep all
+    MaxFiles    int
+    // compress the rotated files by gzip
+    Compress    bool
+}
+
+// the log file sink, its methods are called with the lock of log output
+// held, except the background cleanup of rotated files
+type LogFile struct {
+    path        string
+    options     LogFileOptions
+    file        *os.File
+    // the size of current file
+    size        int64
+    // the next time of rotation, zero if there is no interval
+    next        time.Time
+    // serialize the compression and cleanup of rotated files
+    rotated     sync.Mutex
+}
+
+
+/**********************************************************************
+* @Function: OpenLogFile(path string, options LogFileOptions) (*LogFile,
+*   error)
+* @Description: open the log file, the new lines are appended to it
+* @Parameter: path string, the file path
+* @Parameter: options LogFileOptions, the rotation options
+* @Return: (*LogFile, error), the log file and error
+**********************************************************************/
+func OpenLogFile(path string, options LogFileOptions) (*LogFile, error) {
+    this := &LogFile{path: path, options: options}
+    err := this.open()
+    if err != nil {
+        return nil, err
+    }
+    return this, nil
+}
+
+
+/**********************************************************************
+* @Function: (this *LogFile) open() (error)
+* @Description: open the file and reset the rotation state
+* @Parameter: nil
+* @Return: error, the error
+**********************************************************************/
+func (this *LogFile) open() (error) {
+    file, err := os.OpenFile(this.path, os.O_WRONLY | os.O_CREATE | os.O_APPEND,
+                             0644)
+    if err != nil {
+        return err
+    }
+    info, err := file.Stat()
+    if err != nil {
+        file.Close()
+        return err
+    }
+    this.file = file
+    this.size = info.Size()
+    if this.options.Interval > 0 {
+        now := time.Now()
+        this.next = now.Truncate(this.options.Interval).Add(this.options.Interval)
+    }
+    return nil
+}
+
+
+/**********************************************************************
+* @Function: (this *LogFile) WriteLog(level uint32, line []byte) (error)
+* @Description: write the log line, rotate the file before writing if the
+*   size or age exceeds the limit, the line is still written if the
+*   rotation fails but the file is reopened
+* @Parameter: level uint32, the log level
+* @Parameter: line []byte, the formatted log line
+* @Return: error, the error
+**********************************************************************/
+func (this *LogFile) WriteLog(level uint32, line []byte) (error) {
+    if this.file == nil {
+        // the last reopening failed, try it again
+        err := this.open()
+        if err != nil {
+            return err
+        }
+    }
+
+    var rerr error = nil
+    maxSize := this.options.MaxSize
+    expired := !this.next.IsZero() && !time.Now().Before(this.next)
+    if expired && this.size == 0 {
+        // nothing to rotate, wait for the next interval
+        now := time.Now()
+        this.next = now.Truncate(this.options.Interval).Add(this.options.Interval)
+        expired = false
+    }
+    if (maxSize > 0 && this.size > 0 && this.size + int64(len(line)) > maxSize) ||
+       expired {
+        rerr = this.rotate()
+        if this.file == nil {
+            return rerr
+        }
+    }
+    n, err := this.file.Write(line)
+    this.size += int64(n)
+    if rerr != nil {
+        return rerr
+    }
+    return err
+}
+
+
+/**********************************************************************
+* @Function: (this *LogFile) rotate() (error)
+* @Description: rename the current file with timestamp and open a new one,
+*   the rotated file is compressed and cleaned up in background
+* @Parameter: nil
+* @Return: error, the error
+**********************************************************************/
+func (this *LogFile) rotate() (error) {
+    this.file.Close()
+    this.file = nil
+
+    // the rotated name is unique, even if it is rotated within one second
+    name := this.path + "." + time.Now().Format(LOG_ROTATE_LAYOUT)
+    rotated := name
+    for i := 1; fileExists(rotated) || fileExists(rotated + ".gz"); i++ {
+        rotated = fmt.Sprintf("%s.%d", name, i)
+    }
+    err := os.Rename(this.path, rotated)
+    if err != nil && !os.IsNotExist(err) {
+        this.open()
+        return err
+    }
+
+    go this.cleanup(rotated)
+    return this.open()
+}
+
+
+/**********************************************************************
+* @Function: (this *LogFile) cleanup(rotated string)
+* @Description: compress the rotated file, and remove the oldest rotated
+*   files beyond the retained count
+* @Parameter: rotated string, the path of rotated file
+* @Return: nil
+**********************************************************************/
+func (this *LogFile) cleanup(rotated string) {
+    this.rotated.Lock()
+    defer this.rotated.Unlock()
+
+    if this.options.Compress {
+        err := compressFile(rotated)
+        if err != nil {
+            LogWarn("compress log file [%s] error, %s", rotated, err)
+        }
+    }
+    if this.options.MaxFiles <= 0 {
+        return
+    }
+
+    // the rotated files sort by the timestamp in name
+    files, err := filepath.Glob(this.path + ".*")
+    if err != nil {
+        return
+    }
+    var olds []string
+    for _, file := range files {
+        suffix := strings.TrimPrefix(file, this.path + ".")
+        if len(suffix) < len(LOG_ROTATE_LAYOUT) {
+            continue
+        }
+        _, err := time.Parse(LOG_ROTATE_LAYOUT, suffix[:len(LOG_ROTATE_LAYOUT)])
+        if err == nil {
+            olds = append(olds, file)
+        }
+    }
+    sort.Strings(olds)
+    for len(olds) > this.options.MaxFiles {
+        os.Remove(olds[0])
+        olds = olds[1:]
+    }
+}
+
+
+/**********************************************************************
+* @Function: fileExists(path string) (bool)
+* @Description: check whether the file exists
+* @Parameter: path string, the file path
+* @Return: bool, true if the file exists
+**********************************************************************/
+func fileExists(path string) (bool) {
+    _, err := os.Lstat(path)
+    return !os.IsNotExist(err)
+}
+
+
+/**********************************************************************
+* @Function: compressFile(path string) (error)
+* @Description: compress the file to "path.gz" and remove the original
+* @Parameter: path string, the file path
+* @Return: error, the error
+**********************************************************************/
+func compressFile(path string) (error) {
+    src, err := os.Open(path)
+    if err != nil {
+        return err
+    }
+    defer src.Close()
+    dst, err := os.OpenFile(path + ".gz", os.O_WRONLY | os.O_CREATE | os.O_EXCL,
+                            0644)
+    if err != nil {
+        return err
+    }
+
+    writer := gzip.NewWriter(dst)
+    _, err = io.Copy(writer, src)
+    if err == nil {
+        err = writer.Close()
+    }
+    if err == nil {
+        err = dst.Close()
+    } else {
+        dst.Close()
+    }
+    if err != nil {
+        os.Remove(path + ".gz")
+        return err
+    }
+    return os.Remove(path)
+}
+
+
+/**********************************************************************
+* @Function: (this *LogFile) Reopen() (error)
+* @Description: close and reopen the file, so that the new lines are
+*   written to the new file after the external logrotate moved it
+* @Parameter: nil
+* @Return: error, the error
+**********************************************************************/
+func (this *LogFile) Reopen() (error) {
+    if this.file != nil {
+        this.file.Close()
+        this.file = nil
+    }
+    return this.open()
+}
+
+
+/**********************************************************************
+* @Function: (this *LogFile) Close() (error)
+* @Description: close the file
+* @Parameter: nil
+* @Return: error, the error
+**********************************************************************/
+func (this *LogFile) Close() (error) {
+    if this.file == nil {
+        return nil
+    }
+    err := this.file.Close()
+    this.file = nil
+    return err
+}
@@ -0,0 +1,214 @@
+/**
+* Filename: logfile_test.go
+* Description: the unit tests of log file rotation
+* Author: knownsec404
+* Time: 2020.10.23
+*/
+
+package forward
+
+import (
+    "compress/gzip"
+    "fmt"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "testing"
+    "time"
+)
+
+
+/**********************************************************************
+* @Function: logFiles(t *testing.T, dir string) ([]string)
+* @Description: list the files in directory
+* @Parameter: t *testing.T, the test
+* @Parameter: dir string, the directory
+* @Return: []string, the file names
+**********************************************************************/
+func logFiles(t *testing.T, dir string) ([]string) {
+    infos, err := ioutil.ReadDir(dir)
+    if err != nil {
+        t.Fatal(err)
+    }
+    names := make([]string, 0, len(infos))
+    for _, info := range infos {
+        names = append(names, info.Name())
+    }
+    return names
+}
+
+
+func TestLogFileIntervalRotation(t *testing.T) {
+    dir, err := ioutil.TempDir("", "pflog")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+    f, err := OpenLogFile(filepath.Join(dir, "pf.log"),
+                          LogFileOptions{Interval: time.Hour})
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer f.Close()
+
+    // the empty file is not rotated, the next rotation is postponed
+    f.next = time.Now().Add(-time.Second)
+    err = f.WriteLog(LOG_LEVEL_INFO, []byte("first\n"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if names := logFiles(t, dir); len(names) != 1 {
+        t.Fatalf("files = %v, want [pf.log]", names)
+    }
+    if !f.next.After(time.Now()) {
+        t.Fatalf("next rotation = %s, want in the future", f.next)
+    }
+
+    // the file with data is rotated
+    f.next = time.Now().Add(-time.Second)
+    err = f.WriteLog(LOG_LEVEL_INFO, []byte("second\n"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if names := logFiles(t, dir); len(names) != 2 {
+        t.Fatalf("files = %v, want pf.log and the rotated one", names)
+    }
+}
+
+
+/**********************************************************************
+* @Function: waitLogFiles(t *testing.T, dir string,
+*   done func(names []string) (bool)) ([]string)
+* @Description: wait for the background cleanup of rotated files
+* @Parameter: t *testing.T, the test
+* @Parameter: dir string, the directory
+* @Parameter: done func(names []string) (bool), check the file names
+* @Return: []string, the file names
+**********************************************************************/
+func waitLogFiles(t *testing.T, dir string,
+    done func(names []string) (bool)) ([]string) {
+    names := logFiles(t, dir)
+    for i := 0; i < 100 && !done(names); i++ {
+        time.Sleep(20 * time.Millisecond)
+        names = logFiles(t, dir)
+    }
+    return names
+}
+
+
+func TestLogFileSizeRotation(t *testing.T) {
+    dir, err := ioutil.TempDir("", "pflog")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+    path := filepath.Join(dir, "pf.log")
+    f, err := OpenLogFile(path, LogFileOptions{MaxSize: 10})
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer f.Close()
+
+    // the second line exceeds the size, the first one is rotated
+    for _, line := range []string{"first\n", "second\n"} {
+        err = f.WriteLog(LOG_LEVEL_INFO, []byte(line))
+        if err != nil {
+            t.Fatal(err)
+        }
+    }
+    names := logFiles(t, dir)
+    if len(names) != 2 {
+        t.Fatalf("files = %v, want pf.log and the rotated one", names)
+    }
+    data, err := ioutil.ReadFile(path)
+    if err != nil || string(data) != "second\n" {
+        t.Fatalf("pf.log = %q, %v, want \"second\\n\"", data, err)
+    }
+    data, err = ioutil.ReadFile(filepath.Join(dir, names[1]))
+    if err != nil || string(data) != "first\n" {
+        t.Fatalf("%s = %q, %v, want \"first\\n\"", names[1], data, err)
+    }
+}
+
+
+func TestLogFileCompress(t *testing.T) {
+    dir, err := ioutil.TempDir("", "pflog")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+    f, err := OpenLogFile(filepath.Join(dir, "pf.log"),
+                          LogFileOptions{MaxSize: 10, Compress: true})
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer f.Close()
+
+    for _, line := range []string{"first\n", "second\n"} {
+        err = f.WriteLog(LOG_LEVEL_INFO, []byte(line))
+        if err != nil {
+            t.Fatal(err)
+        }
+    }
+    // the rotated file is replaced by the compressed one
+    names := waitLogFiles(t, dir, func(names []string) (bool) {
+        return len(names) == 2 && filepath.Ext(names[1]) == ".gz"
+    })
+    if len(names) != 2 || filepath.Ext(names[1]) != ".gz" {
+        t.Fatalf("files = %v, want pf.log and the compressed one", names)
+    }
+    file, err := os.Open(filepath.Join(dir, names[1]))
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer file.Close()
+    reader, err := gzip.NewReader(file)
+    if err != nil {
+        t.Fatal(err)
+    }
+    data, err := ioutil.ReadAll(reader)
+    if err != nil || string(data) != "first\n" {
+        t.Fatalf("%s = %q, %v, want \"first\\n\"", names[1], data, err)
+    }
+}
+
+
+func TestLogFileMaxFiles(t *testing.T) {
+    dir, err := ioutil.TempDir("", "pflog")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+    f, err := OpenLogFile(filepath.Join(dir, "pf.log"),
+                          LogFileOptions{MaxSize: 1, MaxFiles: 2})
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer f.Close()
+
+    // each line is rotated by the next one
+    for i := 1; i <= 5; i++ {
+        err = f.WriteLog(LOG_LEVEL_INFO, []byte(fmt.Sprintf("line%d\n", i)))
+        if err != nil {
+            t.Fatal(err)
+        }
+    }
+    // only the newest rotated files are retained
+    names := waitLogFiles(t, dir, func(names []string) (bool) {
+        return len(names) == 3
+    })
+    if len(names) != 3 {
+        t.Fatalf("files = %v, want pf.log and 2 rotated ones", names)
+    }
+    lines := ""
+    for _, name := range names[1:] {
+        data, err := ioutil.ReadFile(filepath.Join(dir, name))
+        if err != nil {
+            t.Fatal(err)
+        }
+        lines += string(data)
+    }
+    if lines != "line3\nline4\n" {
+        t.Fatalf("rotated files = %q, want \"line3\\nline4\\n\"", lines)
+    }
+}
@@ -0,0 +1,198 @@
+/**
+* Filename: logsink.go
+* Description: the log sinks, the formatted log line is written to stdout,
+*   stderr, file, or the local syslog daemon over unix socket:
+*   stdout              the standard output (default)
+*   stderr              the standard error
+*   file:/path/to/log   append to the file, see logfile.go for rotation
+*   syslog[:/dev/log]   the local syslog daemon, facility "daemon"
+* Author: knownsec404
+* Time: 2020.10.23
+*/
+
+package forward
+
+import (
+    "bytes"
+    "fmt"
+    "io"
+    "net"
+    "os"
+    "strings"
+    "time"
+)
+
+// the default unix socket of local syslog daemon
+const SYSLOG_PATH string = "/dev/log"
+
+// the facility "daemon" of syslog
+const SYSLOG_FACILITY int = 3
+
+// the log sink, its methods are called with the lock of log output held,
+// so that they are not called concurrently
+type LogSink interface {
+    // WriteLog writes the formatted log line of level.
+    WriteLog(level uint32, line []byte) (error)
+    // Close closes the sink.
+    Close() (error)
+}
+
+// the sink of writer, such as stdout and stderr
+type writerSink struct {
+    w           io.Writer
+    // nil if the writer is not closed with sink, such as stdout
+    closer      io.Closer
+}
+
+// the default sink
+var stdoutSink = &writerSink{w: os.Stdout}
+
+// the sink of local syslog daemon
+type syslogSink struct {
+    path        string
+    conn        net.Conn
+    tag         string
+}
+
+
+/**********************************************************************
+* @Function: OpenLogSink(spec string) (LogSink, error)
+* @Description: open the log sink, the spec is "stdout", "stderr",
+*   "file:/path/to/log", "syslog" or "syslog:/path/to/sock"
+* @Parameter: spec string, the sink spec
+* @Return: (LogSink, error), the log sink and error
+**********************************************************************/
+func OpenLogSink(spec string) (LogSink, error) {
+    kind := spec
+    path := ""
+    if i := strings.Index(spec, ":"); i >= 0 {
+        kind, path = spec[:i], spec[i + 1:]
+    }
+
+    switch {
+    case kind == "stdout" && path == "":
+        return stdoutSink, nil
+    case kind == "stderr" && path == "":
+        return &writerSink{w: os.Stderr}, nil
+    case kind == "file" && path != "":
+        return OpenLogFile(path, LogFileOptions{})
+    case kind == "syslog":
+        if path == "" {
+            path = SYSLOG_PATH
+        }
+        sink := &syslogSink{path: path, tag: "portforward"}
+        err := sink.connect()
+        if err != nil {
+            return nil, err
+        }
+        return sink, nil
+    }
+    return nil, fmt.Errorf("unknown log output [%s]", spec)
+}
+
+
+/**********************************************************************
+* @Function: (this *writerSink) WriteLog(level uint32, line []byte) (error)
+* @Description: write the log line
+* @Parameter: level uint32, the log level
+* @Parameter: line []byte, the formatted log line
+* @Return: error, the error
+**********************************************************************/
+func (this *writerSink) WriteLog(level uint32, line []byte) (error) {
+    _, err := this.w.Write(line)
+    return err
+}
+
+
+/**********************************************************************
+* @Function: (this *writerSink) Close() (error)
+* @Description: close the writer, stdout and stderr are not closed
+* @Parameter: nil
+* @Return: error, the error
+**********************************************************************/
+func (this *writerSink) Close() (error) {
+    if this.closer == nil {
+        return nil
+    }
+    return this.closer.Close()
+}
+
+
+/**********************************************************************
+* @Function: (this *syslogSink) connect() (error)
+* @Description: connect to the local syslog daemon, try datagram socket
+*   first and then stream socket
+* @Parameter: nil
+* @Return: error, the error
+**********************************************************************/
+func (this *syslogSink) connect() (error) {
+    var err error
+    for _, network := range []string{"unixgram", "unix"} {
+        var conn net.Conn
+        conn, err = net.Dial(network, this.path)
+        if err == nil {
+            this.conn = conn
+            return nil
+        }
+    }
+    return err
+}
+
+
+/**********************************************************************
+* @Function: (this *syslogSink) WriteLog(level uint32, line []byte) (error)
+* @Description: send the log line to syslog daemon in the format of local
+*   syslog, "<priority>timestamp tag[pid]: message", reconnect once if
+*   the daemon has restarted
+* @Parameter: level uint32, the log level
+* @Parameter: line []byte, the formatted log line
+* @Return: error, the error
+**********************************************************************/
+func (this *syslogSink) WriteLog(level uint32, line []byte) (error) {
+    // the syslog severity of log level
+    severity := 7
+    switch level {
+    case LOG_LEVEL_FATAL:
+        severity = 2
+    case LOG_LEVEL_ERROR:
+        severity = 3
+    case LOG_LEVEL_WARN:
+        severity = 4
+    case LOG_LEVEL_INFO:
+        severity = 6
+    }
+    msg := fmt.Sprintf("<%d>%s %s[%d]: %s\n", SYSLOG_FACILITY * 8 + severity,
+                       time.Now().Format(time.Stamp), this.tag, os.Getpid(),
+                       bytes.TrimRight(line, "\n"))
+
+    if this.conn != nil {
+        _, err := this.conn.Write([]byte(msg))
+        if err == nil {
+            return nil
+        }
+        this.conn.Close()
+        this.conn = nil
+    }
+    err := this.connect()
+    if err != nil {
+        return err
+    }
+    _, err = this.conn.Write([]byte(msg))
+    return err
+}
+
+
+/**********************************************************************
+* @Function: (this *syslogSink) Close() (error)
+* @Description: close the connection to syslog daemon
+* @Parameter: nil
+* @Return: error, the error
+**********************************************************************/
+func (this *syslogSink) Close() (error) {
+    if this.conn == nil {
+        return nil
+    }
+    err := this.conn.Close()
+    this.conn = nil
+    return err
+}
@@ -0,0 +1,533 @@
+/**
+* Filename: manager.go
+* Description: the PortForward rule manager, it runs a group of forwarders
+*   keyed by rule name, and supports applying a new rule set at runtime: the
+*   unchanged rules keep running (their links are not affected), the changed
+*   and removed rules are shut down gracefully, the new rules are started.
+*   The single rule can also be added, removed, paused and resumed. The
+*   rules are shut down without holding the mutex of status, so that the
+*   status can be got while their links are draining.
+* Author: knownsec404
+* Time: 2020.10.22
+*/
+
+package forward
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "reflect"
+    "sync"
+    "time"
+)
+
+// the state of rule
+const RULE_STATE_RUNNING string = "running"
+const RULE_STATE_PAUSED  string = "paused"
+const RULE_STATE_EXITED  string = "exited"
+
+// the status of rule in the rule set
+type RuleStatus struct {
+    Name        string      `json:"name"`
+    Proto       string      `json:"proto"`
+    Sock1       string      `json:"sock1"`
+    Sock2       string      `json:"sock2"`
+    State       string      `json:"state"`
+    Stats       RuleStats   `json:"stats"`
+}
+
+// the PortForward rule manager
+type Manager struct {
+    logger      Logger
+    // the grace period of shutting down a changed or removed rule
+    Grace       time.Duration
+    // the timeout settings of lower priority than the ones of rule, such as
+    // the settings of command-line, it should be set before rules apply
+    Timeouts    Timeouts
+    // serialize the changes of rule set, it is held while shutting down
+    update      sync.Mutex
+    // protect the status below, it is never held while shutting down
+    mutex       sync.Mutex
+    forwarders  map[string]*Forwarder
+    // the rule set in order, the paused rules have no forwarder
+    rules       []Args
+    paused      map[string]bool
+    // the rules added at runtime, they are kept by "Apply()"
+    added       map[string]bool
+    // the number of running forwarders and applying changes, "idle" is
+    // closed when it is 0
+    running     int
+    idle        chan bool
+}
+
+
+/**********************************************************************
+* @Function: NewManager() (*Manager)
+* @Description: initialize Manager structure, the default logger is
+*   "StdLogger" and the default grace period is 30 seconds
+* @Parameter: nil
+* @Return: *Manager, the new Manager structure pointer
+**********************************************************************/
+func NewManager() (*Manager) {
+    idle := make(chan bool)
+    close(idle)
+    return &Manager{
+        logger:     StdLogger{},
+        Grace:      30 * time.Second,
+        forwarders: make(map[string]*Forwarder),
+        paused:     make(map[string]bool),
+        added:      make(map[string]bool),
+        idle:       idle,
+    }
+}
+
+
+/**********************************************************************
+* @Function: (this *Manager) SetLogger(logger Logger)
+* @Description: set the logger of manager and the forwarders started later
+* @Parameter: logger Logger, the logger
+* @Return: nil
+**********************************************************************/
+func (this *Manager) SetLogger(logger Logger) {
+    this.logger = logger
+}
+
+
+/**********************************************************************
+* @Function: (this *Manager) Apply(rules []Args)
+* @Description: apply the rule set, rules are identified by name: the
+*   unchanged rules keep running, the changed and removed rules are shut
+*   down within grace period, then the changed and new rules are started.
+*   the rule which is still in the rule set keeps paused. the rule added
+*   by "Add()" is kept unless the rule set has the rule of the same name.
+*   the zero timeout settings of rules are set to the ones of manager
+* @Parameter: rules []Args, the launch arguments of every rule
+* @Return: nil
+**********************************************************************/
+func (this *Manager) Apply(rules []Args) {
+    this.change(func() (error) {
+        names := make(map[string]bool)
+        for _, args := range rules {
+            names[args.Name] = true
+        }
+        kept := make([]Args, 0, len(rules))
+        for _, args := range rules {
+            args.Timeouts = args.Timeouts.merge(this.Timeouts)
+            kept = append(kept, args)
+        }
+        for _, args := range this.rules {
+            if !this.added[args.Name] {
+                continue
+            }
+            logger := NewRuleLogger(this.logger, args.Name)
+            if names[args.Name] {
+                logger.Warn("rule added at runtime is replaced by rule set")
+                delete(this.added, args.Name)
+                continue
+            }
+            logger.Info("rule added at runtime is kept")
+            kept = append(kept, args)
+        }
+
+        this.rules = kept
+        paused := this.paused
+        this.paused = make(map[string]bool)
+        for _, args := range kept {
+            if paused[args.Name] {
+                this.paused[args.Name] = true
+            }
+        }
+        return nil
+    })
+}
+
+
+/**********************************************************************
+* @Function: (this *Manager) change(fn func() (error)) (error)
+* @Description: change the rule set by "fn" holding the mutex, then apply
+*   it without holding the mutex, the changes are serialized
+* @Parameter: fn func() (error), change the rule set, the rule set is not
+*   applied if it returns error
+* @Return: error, the error of "fn"
+**********************************************************************/
+func (this *Manager) change(fn func() (error)) (error) {
+    this.update.Lock()
+    defer this.update.Unlock()
+
+    this.mutex.Lock()
+    err := fn()
+    this.mutex.Unlock()
+    if err != nil {
+        return err
+    }
+    this.apply()
+    return nil
+}
+
+
+/**********************************************************************
+* @Function: (this *Manager) apply()
+* @Description: run the forwarders of the rule set except the paused rules,
+*   the caller must hold "update" but not the mutex, the changed and
+*   removed rules are kept in status until they are shut down
+* @Parameter: nil
+* @Return: nil
+**********************************************************************/
+func (this *Manager) apply() {
+    // hold the manager, so that "Wait()" does not return while the changed
+    // rules are restarting
+    this.mutex.Lock()
+    this.hold()
+    defer func() {
+        this.mutex.Lock()
+        this.release()
+        this.mutex.Unlock()
+    }()
+
+    // find the changed and removed rules
+    rules := this.rules
+    news := make(map[string]Args)
+    for _, args := range rules {
+        if !this.paused[args.Name] {
+            news[args.Name] = args
+        }
+    }
+    olds := make([]*Forwarder, 0)
+    for name, f := range this.forwarders {
+        args, ok := news[name]
+        if ok && reflect.DeepEqual(args, f.args) && !f.exited() {
+            delete(news, name)
+            continue
+        }
+        logger := NewRuleLogger(this.logger, name)
+        if ok && f.exited() {
+            logger.Info("rule has exited, restart")
+        } else if ok {
+            logger.Info("rule changed, restart")
+        } else if this.paused[name] {
+            logger.Info("rule paused, shutdown")
+        } else {
+            logger.Info("rule removed, shutdown")
+        }
+        olds = append(olds, f)
+    }
+    this.mutex.Unlock()
+
+    // shutdown the changed and removed rules concurrently
+    ctx, cancel := context.WithTimeout(context.Background(), this.Grace)
+    defer cancel()
+    var wg sync.WaitGroup
+    for _, f := range olds {
+        wg.Add(1)
+        go func(f *Forwarder) {
+            defer wg.Done()
+            f.Shutdown(ctx)
+        }(f)
+    }
+    wg.Wait()
+
+    this.mutex.Lock()
+    defer this.mutex.Unlock()
+    for _, f := range olds {
+        delete(this.forwarders, f.args.Name)
+    }
+    // start the changed and new rules, keep the order of rule set
+    for _, args := range rules {
+        if _, ok := news[args.Name]; !ok {
+            continue
+        }
+        f := NewForwarder(args)
+        f.SetLogger(this.logger)
+        err := f.Start(context.Background())
+        if err != nil {
+            NewRuleLogger(this.logger, args.Name).Error("%s", err)
+            continue
+        }
+        this.forwarders[args.Name] = f
+        this.hold()
+        go func() {
+            f.Wait()
+            this.mutex.Lock()
+            this.release()
+            this.mutex.Unlock()
+        }()
+    }
+}
+
+
+/**********************************************************************
+* @Function: (this *Manager) hold()
+* @Description: count a running forwarder or applying change, the caller
+*   must hold the mutex
+* @Parameter: nil
+* @Return: nil
+**********************************************************************/
+func (this *Manager) hold() {
+    if this.running == 0 {
+        this.idle = make(chan bool)
+    }
+    this.running++
+}
+
+
+/**********************************************************************
+* @Function: (this *Manager) release()
+* @Description: uncount a running forwarder or applying change, "Wait()"
+*   returns when nothing is running, the caller must hold the mutex
+* @Parameter: nil
+* @Return: nil
+**********************************************************************/
+func (this *Manager) release() {
+    this.running--
+    if this.running == 0 {
+        close(this.idle)
+    }
+}
+
+
+/**********************************************************************
+* @Function: (this *Manager) find(name string) (int)
+* @Description: find the rule in the rule set, the caller must hold the
+*   mutex
+* @Parameter: name string, the rule name
+* @Return: int, the index of rule, -1 if it is not found
+**********************************************************************/
+func (this *Manager) find(name string) (int) {
+    for i, args := range this.rules {
+        if args.Name == name {
+            return i
+        }
+    }
+    return -1
+}
+
+
+/**********************************************************************
+* @Function: (this *Manager) Add(args Args) (error)
+* @Description: add a rule to the rule set and start it, the zero timeout
+*   settings of rule are set to the ones of manager
+* @Parameter: args Args, the launch arguments of rule
+* @Return: error, the error if the rule name is empty or duplicate
+**********************************************************************/
+func (this *Manager) Add(args Args) (error) {
+    return this.change(func() (error) {
+        if args.Name == "" {
+            return errors.New("rule name is empty")
+        }
+        if this.find(args.Name) >= 0 {
+            return fmt.Errorf("rule [%s] already exists", args.Name)
+        }
+        args.Timeouts = args.Timeouts.merge(this.Timeouts)
+        rules := make([]Args, 0, len(this.rules) + 1)
+        this.rules = append(append(rules, this.rules...), args)
+        this.added[args.Name] = true
+        NewRuleLogger(this.logger, args.Name).Info("rule added")
+        return nil
+    })
+}
+
+
+/**********************************************************************
+* @Function: (this *Manager) Remove(name string) (error)
+* @Description: remove a rule from the rule set, shut it down gracefully
+* @Parameter: name string, the rule name
+* @Return: error, the error if the rule is not found
+**********************************************************************/
+func (this *Manager) Remove(name string) (error) {
+    return this.change(func() (error) {
+        i := this.find(name)
+        if i < 0 {
+            return fmt.Errorf("rule [%s] not found", name)
+        }
+        rules := make([]Args, 0, len(this.rules) - 1)
+        rules = append(rules, this.rules[:i]...)
+        this.rules = append(rules, this.rules[i + 1:]...)
+        delete(this.paused, name)
+        delete(this.added, name)
+        return nil
+    })
+}
+
+
+/**********************************************************************
+* @Function: (this *Manager) Pause(name string) (error)
+* @Description: pause a rule, it is shut down gracefully but kept in the
+*   rule set, so that it can be resumed
+* @Parameter: name string, the rule name
+* @Return: error, the error if the rule is not found or has been paused
+**********************************************************************/
+func (this *Manager) Pause(name string) (error) {
+    return this.change(func() (error) {
+        if this.find(name) < 0 {
+            return fmt.Errorf("rule [%s] not found", name)
+        }
+        if this.paused[name] {
+            return fmt.Errorf("rule [%s] has been paused", name)
+        }
+        this.paused[name] = true
+        return nil
+    })
+}
+
+
+/**********************************************************************
+* @Function: (this *Manager) Resume(name string) (error)
+* @Description: resume a paused rule
+* @Parameter: name string, the rule name
+* @Return: error, the error if the rule is not found or not paused
+**********************************************************************/
+func (this *Manager) Resume(name string) (error) {
+    return this.change(func() (error) {
+        if this.find(name) < 0 {
+            return fmt.Errorf("rule [%s] not found", name)
+        }
+        if !this.paused[name] {
+            return fmt.Errorf("rule [%s] is not paused", name)
+        }
+        delete(this.paused, name)
+        NewRuleLogger(this.logger, name).Info("rule resumed")
+        return nil
+    })
+}
+
+
+/**********************************************************************
+* @Function: (this *Manager) Rules() ([]RuleStatus)
+* @Description: get the status of every rule in the rule set
+* @Parameter: nil
+* @Return: []RuleStatus, the rule status in order
+**********************************************************************/
+func (this *Manager) Rules() ([]RuleStatus) {
+    this.mutex.Lock()
+    defer this.mutex.Unlock()
+
+    rules := make([]RuleStatus, 0, len(this.rules))
+    for _, args := range this.rules {
+        status := RuleStatus{
+            Name:       args.Name,
+            Proto:      FormatProto(args.Protocol),
+            Sock1:      args.Endpoint(1).String(),
+            Sock2:      args.Endpoint(2).String(),
+            State:      RULE_STATE_PAUSED,
+        }
+        if f, ok := this.forwarders[args.Name]; ok {
+            status.State = RULE_STATE_RUNNING
+            if f.exited() {
+                status.State = RULE_STATE_EXITED
+            }
+            status.Stats = f.Stats()
+        } else if !this.paused[args.Name] {
+            // the rule failed to start
+            status.State = RULE_STATE_EXITED
+        }
+        rules = append(rules, status)
+    }
+    return rules
+}
+
+
+/**********************************************************************
+* @Function: (this *Manager) Links(name string) ([]LinkStats, error)
+* @Description: get the statistics of the active links of rule
+* @Parameter: name string, the rule name
+* @Return: ([]LinkStats, error), the link statistics and error if the
+*   rule is not found
+**********************************************************************/
+func (this *Manager) Links(name string) ([]LinkStats, error) {
+    this.mutex.Lock()
+    defer this.mutex.Unlock()
+
+    if this.find(name) < 0 {
+        return nil, fmt.Errorf("rule [%s] not found", name)
+    }
+    f, ok := this.forwarders[name]
+    if !ok {
+        return []LinkStats{}, nil
+    }
+    return f.Links(), nil
+}
+
+
+/**********************************************************************
+* @Function: (this *Manager) CloseLink(name string, id int) (error)
+* @Description: close an active link of rule
+* @Parameter: name string, the rule name
+* @Parameter: id int, the link id
+* @Return: error, the error if the rule or link is not found
+**********************************************************************/
+func (this *Manager) CloseLink(name string, id int) (error) {
+    this.mutex.Lock()
+    defer this.mutex.Unlock()
+
+    f, ok := this.forwarders[name]
+    if !ok || !f.CloseLink(id) {
+        return fmt.Errorf("link%d of rule [%s] not found", id, name)
+    }
+    return nil
+}
+
+
+/**********************************************************************
+* @Function: (this *Manager) Shutdown(ctx context.Context) (error)
+* @Description: shutdown all of the forwarders gracefully and concurrently,
+*   it returns only when every forwarder has exited
+* @Parameter: ctx context.Context, the deadline of draining links
+* @Return: error, the "ctx" error if links are closed forcibly
+**********************************************************************/
+func (this *Manager) Shutdown(ctx context.Context) (error) {
+    this.update.Lock()
+    defer this.update.Unlock()
+
+    this.mutex.Lock()
+    forwarders := this.forwarders
+    this.forwarders = make(map[string]*Forwarder)
+    this.mutex.Unlock()
+
+    var err error = nil
+    var errOnce sync.Once
+    var wg sync.WaitGroup
+    for _, f := range forwarders {
+        wg.Add(1)
+        go func(f *Forwarder) {
+            defer wg.Done()
+            e := f.Shutdown(ctx)
+            if e != nil {
+                errOnce.Do(func() { err = e })
+            }
+        }(f)
+    }
+    wg.Wait()
+    return err
+}
+
+
+/**********************************************************************
+* @Function: (this *Manager) Stats() (map[string]RuleStats)
+* @Description: get the running aggregate of every running rule
+* @Parameter: nil
+* @Return: map[string]RuleStats, the rule statistics keyed by rule name
+**********************************************************************/
+func (this *Manager) Stats() (map[string]RuleStats) {
+    this.mutex.Lock()
+    defer this.mutex.Unlock()
+    stats := make(map[string]RuleStats)
+    for name, f := range this.forwarders {
+        stats[name] = f.Stats()
+    }
+    return stats
+}
+
+
+/**********************************************************************
+* @Function: (this *Manager) Wait()
+* @Description: wait until every forwarder started by manager has exited
+* @Parameter: nil
+* @Return: nil
+**********************************************************************/
+func (this *Manager) Wait() {
+    this.mutex.Lock()
+    idle := this.idle
+    this.mutex.Unlock()
+    <-idle
+}
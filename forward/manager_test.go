@@ -0,0 +1,212 @@
+/**
+* Filename: manager_test.go
+* Description: the unit tests of rule manager
+* Author: knownsec404
+* Time: 2020.10.23
+*/
+
+package forward
+
+import (
+    "context"
+    "io"
+    "net"
+    "testing"
+    "time"
+)
+
+
+/**********************************************************************
+* @Function: testManager(t *testing.T) (*Manager)
+* @Description: create a manager without log, it is shut down after the
+*   test
+* @Parameter: t *testing.T, the test
+* @Return: *Manager, the manager
+**********************************************************************/
+func testManager(t *testing.T) (*Manager) {
+    level := GetLogLevel()
+    SetLogLevel(LOG_LEVEL_NONE)
+    manager := NewManager()
+    t.Cleanup(func() {
+        ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+        defer cancel()
+        manager.Shutdown(ctx)
+        SetLogLevel(level)
+    })
+    return manager
+}
+
+
+/**********************************************************************
+* @Function: testRule(t *testing.T, name string, target string) (Args)
+* @Description: the tcp rule from a free local port to target
+* @Parameter: t *testing.T, the test
+* @Parameter: name string, the rule name
+* @Parameter: target string, the address of conn sock
+* @Return: Args, the rule
+**********************************************************************/
+func testRule(t *testing.T, name string, target string) (Args) {
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    addr := ln.Addr().String()
+    ln.Close()
+    return Args{
+        Name:       name,
+        Protocol:   PORTFORWARD_PROTO_TCP,
+        Method1:    PORTFORWARD_SOCK_LISTEN,
+        Addr1:      addr,
+        Method2:    PORTFORWARD_SOCK_CONN,
+        Addr2:      target,
+    }
+}
+
+
+func TestManagerApplyKeepsAdded(t *testing.T) {
+    manager := testManager(t)
+    manager.Apply([]Args{testRule(t, "a", "127.0.0.1:1")})
+    err := manager.Add(testRule(t, "b", "127.0.0.1:1"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    err = manager.Add(testRule(t, "c", "127.0.0.1:1"))
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    // "b" is kept, "c" is replaced by the rule set
+    c := testRule(t, "c", "127.0.0.1:2")
+    manager.Apply([]Args{c})
+    rules := manager.Rules()
+    names := make([]string, 0, len(rules))
+    for _, rule := range rules {
+        names = append(names, rule.Name)
+    }
+    if len(names) != 2 || names[0] != "c" || names[1] != "b" {
+        t.Fatalf("Rules() = %v, want [c b]", names)
+    }
+    if rules[0].Sock2 != "conn:127.0.0.1:2" {
+        t.Errorf("rule c sock2 = %s, want conn:127.0.0.1:2", rules[0].Sock2)
+    }
+
+    // "c" is not added at runtime any more, it is removed by the rule set
+    manager.Apply(nil)
+    rules = manager.Rules()
+    if len(rules) != 1 || rules[0].Name != "b" {
+        t.Fatalf("Rules() = %v, want [b]", rules)
+    }
+}
+
+
+func TestManagerStatusWhileDraining(t *testing.T) {
+    // the echo server of B point
+    echo, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer echo.Close()
+    go func() {
+        for {
+            conn, err := echo.Accept()
+            if err != nil {
+                return
+            }
+            go func() {
+                defer conn.Close()
+                io.Copy(conn, conn)
+            }()
+        }
+    }()
+
+    manager := testManager(t)
+    manager.Grace = 5 * time.Second
+    rule := testRule(t, "a", echo.Addr().String())
+    manager.Apply([]Args{rule})
+
+    // keep a link active, so that removing the rule waits for draining,
+    // the rule listens asynchronously
+    var conn net.Conn
+    for i := 0; i < 50; i++ {
+        conn, err = net.Dial("tcp", rule.Addr1)
+        if err == nil {
+            break
+        }
+        time.Sleep(20 * time.Millisecond)
+    }
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer conn.Close()
+    conn.SetDeadline(time.Now().Add(5 * time.Second))
+    buf := make([]byte, 4)
+    conn.Write([]byte("ping"))
+    _, err = io.ReadFull(conn, buf)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    removed := make(chan error, 1)
+    go func() {
+        removed <- manager.Remove("a")
+    }()
+    time.Sleep(100 * time.Millisecond)
+
+    status := make(chan int, 1)
+    go func() {
+        status <- len(manager.Rules()) + len(manager.Stats())
+    }()
+    select {
+    case <-status:
+    case <-time.After(time.Second):
+        t.Fatal("Rules() blocks while the rule is draining")
+    }
+    select {
+    case <-removed:
+        t.Fatal("Remove() returns before the link is closed")
+    default:
+    }
+
+    conn.Close()
+    select {
+    case err = <-removed:
+        if err != nil {
+            t.Fatal(err)
+        }
+    case <-time.After(3 * time.Second):
+        t.Fatal("Remove() does not return after the link is closed")
+    }
+}
+
+
+func TestManagerWait(t *testing.T) {
+    manager := testManager(t)
+    // nothing is running
+    manager.Wait()
+
+    manager.Apply([]Args{testRule(t, "a", "127.0.0.1:1")})
+    waited := make(chan bool)
+    go func() {
+        manager.Wait()
+        close(waited)
+    }()
+    // the rule can be added while waiting
+    err := manager.Add(testRule(t, "b", "127.0.0.1:1"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    select {
+    case <-waited:
+        t.Fatal("Wait() returns while the rules are running")
+    case <-time.After(100 * time.Millisecond):
+    }
+
+    ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+    defer cancel()
+    manager.Shutdown(ctx)
+    select {
+    case <-waited:
+    case <-time.After(time.Second):
+        t.Fatal("Wait() does not return after shutdown")
+    }
+}
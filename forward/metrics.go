@@ -0,0 +1,120 @@
+/**
+* Filename: metrics.go
+* Description: the PortForward metrics, the rule statistics of manager are
+*   exposed in Prometheus text format, such as:
+*   portforward_links_active{rule="rdp"} 3
+*   portforward_bytes_total{rule="rdp",direction="up"} 10240
+* Author: knownsec404
+* Time: 2020.10.23
+*/
+
+package forward
+
+import (
+    "bufio"
+    "fmt"
+    "io"
+    "net/http"
+    "sort"
+    "strings"
+)
+
+// the metric exported from rule statistics
+type metric struct {
+    name        string
+    kind        string
+    help        string
+    // the label "direction" of traffic metric, empty means no label
+    direction   string
+    value       func(stats RuleStats) (int64)
+}
+
+// the metrics in order, the metrics with the same name are grouped
+var metrics = []metric{
+    {"portforward_links_active", "gauge", "The number of active links.",
+     "", func(s RuleStats) (int64) { return s.Active }},
+    {"portforward_links_total", "counter", "The number of links connected.",
+     "", func(s RuleStats) (int64) { return s.Links }},
+    {"portforward_accepted_total", "counter",
+     "The number of connections accepted by listeners.",
+     "", func(s RuleStats) (int64) { return s.Accepted }},
+    {"portforward_accept_failed_total", "counter",
+     "The number of failed accepts and rejected handshakes.",
+     "", func(s RuleStats) (int64) { return s.AcceptFailed }},
+    {"portforward_dial_failed_total", "counter", "The number of failed dials.",
+     "", func(s RuleStats) (int64) { return s.DialFailed }},
+    {"portforward_pairing_timeouts_total", "counter",
+     "The number of pending sockets reset by pairing timeout.",
+     "", func(s RuleStats) (int64) { return s.PairingTimeouts }},
+    {"portforward_udp_sessions", "gauge", "The size of udp session tables.",
+     "", func(s RuleStats) (int64) { return s.UDPSessions }},
+    {"portforward_bytes_total", "counter",
+     "The bytes forwarded, up is A point to B point.",
+     "up", func(s RuleStats) (int64) { return s.Up.Bytes }},
+    {"portforward_bytes_total", "counter", "",
+     "down", func(s RuleStats) (int64) { return s.Down.Bytes }},
+    {"portforward_packets_total", "counter",
+     "The packets forwarded, up is A point to B point.",
+     "up", func(s RuleStats) (int64) { return s.Up.Packets }},
+    {"portforward_packets_total", "counter", "",
+     "down", func(s RuleStats) (int64) { return s.Down.Packets }},
+}
+
+
+/**********************************************************************
+* @Function: WriteMetrics(w io.Writer, stats map[string]RuleStats) (error)
+* @Description: write the rule statistics in Prometheus text format
+* @Parameter: w io.Writer, the writer
+* @Parameter: stats map[string]RuleStats, the rule statistics keyed by name
+* @Return: error, the error
+**********************************************************************/
+func WriteMetrics(w io.Writer, stats map[string]RuleStats) (error) {
+    names := make([]string, 0, len(stats))
+    for name := range stats {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+
+    bw := bufio.NewWriter(w)
+    for _, m := range metrics {
+        if m.help != "" {
+            fmt.Fprintf(bw, "# HELP %s %s\n", m.name, m.help)
+            fmt.Fprintf(bw, "# TYPE %s %s\n", m.name, m.kind)
+        }
+        for _, name := range names {
+            labels := fmt.Sprintf("rule=\"%s\"", escapeLabel(name))
+            if m.direction != "" {
+                labels += fmt.Sprintf(",direction=\"%s\"", m.direction)
+            }
+            fmt.Fprintf(bw, "%s{%s} %d\n", m.name, labels, m.value(stats[name]))
+        }
+    }
+    return bw.Flush()
+}
+
+
+/**********************************************************************
+* @Function: escapeLabel(value string) (string)
+* @Description: escape the label value of Prometheus text format
+* @Parameter: value string, the label value
+* @Return: string, the escaped label value
+**********************************************************************/
+func escapeLabel(value string) (string) {
+    value = strings.Replace(value, "\\", "\\\\", -1)
+    value = strings.Replace(value, "\"", "\\\"", -1)
+    return strings.Replace(value, "\n", "\\n", -1)
+}
+
+
+/**********************************************************************
+* @Function: MetricsHandler(manager *Manager) (http.Handler)
+* @Description: get the http handler which serves the metrics of manager
+* @Parameter: manager *Manager, the rule manager
+* @Return: http.Handler, the http handler
+**********************************************************************/
+func MetricsHandler(manager *Manager) (http.Handler) {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+        WriteMetrics(w, manager.Stats())
+    })
+}
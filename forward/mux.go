@@ -0,0 +1,877 @@
+/**
+* Filename: mux.go
+* Description: the PortForward multiplexing layer, two PortForward instances
+*   keep one long-lived connection (session) and carry many logical links
+*   (streams) over it, so that a new link does not need a new connection.
+*   The conn sock opens a stream on the shared session for each dial, the
+*   listen sock accepts sessions and returns each stream as a connection.
+*   The session is started by "PFM1" from the conn sock, then the data is
+*   sent by frames: type(1) + stream id(4) + length(4) + payload, all of
+*   the numbers are big endian. Each stream has its own receive window, the
+*   sender stops when the window is exhausted until "WINDOW" frame returns
+*   the consumed bytes, so that a slow link does not block the others, and
+*   the stream is reset if the peer sends more than the window. The ping
+*   and pong are written by the keepalive goroutine one by one.
+* Author: knownsec404
+* Time: 2020.10.22
+*/
+
+package forward
+
+import (
+    "context"
+    "encoding/binary"
+    "errors"
+    "io"
+    "net"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+const muxMagic string = "PFM1"
+const (
+    MUX_FRAME_DATA      uint8 = 0x00
+    MUX_FRAME_OPEN      uint8 = 0x01
+    MUX_FRAME_CLOSE     uint8 = 0x02
+    MUX_FRAME_WINDOW    uint8 = 0x03
+    MUX_FRAME_PING      uint8 = 0x04
+    MUX_FRAME_PONG      uint8 = 0x05
+)
+const muxHeaderSize int = 9
+// the maximum payload size of data frame
+const muxFrameSize uint32 = 32 * 1024
+// the receive window of each stream
+const muxWindowSize uint32 = 256 * 1024
+// the session sends ping in the interval, and it is closed if nothing is
+// received in 3 intervals
+const muxKeepalive time.Duration = 30 * time.Second
+// the session of conn sock is closed when it has no stream for a while
+const muxIdleTimeout time.Duration = 30 * time.Second
+
+var errMuxClosed = errors.New("mux stream closed")
+var errMuxWindow = errors.New("mux stream reset, receive window exceeded")
+
+// the timeout error of stream deadline
+type muxTimeoutError struct{}
+
+func (muxTimeoutError) Error() string   { return "mux stream i/o timeout" }
+func (muxTimeoutError) Timeout() bool   { return true }
+func (muxTimeoutError) Temporary() bool { return true }
+
+// the multiplexing session over one connection
+type MuxSession struct {
+    conn        Conn
+    // the session is started by conn sock, it opens the streams
+    client      bool
+    logger      Logger
+    // the frames are written by multiple streams
+    wmutex      sync.Mutex
+    mutex       sync.Mutex
+    streams     map[uint32]*MuxStream
+    nextId      uint32
+    // reject new streams, and close the session after all streams closed
+    draining    bool
+    // the time since the session has no stream
+    idle        time.Time
+    // the unix nano time of last received frame
+    lastRecv    int64
+    // the value of ping to be answered by keepalive goroutine
+    pongc       chan uint32
+    acceptc     chan *MuxStream
+    closed      chan bool
+    closeOnce   sync.Once
+}
+
+
+/**********************************************************************
+* @Function: NewMuxSession(conn Conn, client bool, logger Logger) (*MuxSession, error)
+* @Description: initialize MuxSession structure on the connection, the
+*   client sends the magic and the server verifies it, then launch the
+*   receiving and keepalive goroutines
+* @Parameter: conn Conn, the underlying connection
+* @Parameter: client bool, true if the session is started by conn sock
+* @Parameter: logger Logger, the logger
+* @Return: (*MuxSession, error), the new MuxSession structure pointer and
+*   error
+**********************************************************************/
+func NewMuxSession(conn Conn, client bool, logger Logger) (*MuxSession, error) {
+    setDeadline(conn, time.Now().Add(10 * time.Second))
+    if client {
+        _, err := conn.Write([]byte(muxMagic))
+        if err != nil {
+            return nil, err
+        }
+    } else {
+        magic := make([]byte, len(muxMagic))
+        _, err := io.ReadFull(conn, magic)
+        if err != nil {
+            return nil, errors.New("mux handshake error, " + err.Error())
+        }
+        if string(magic) != muxMagic {
+            return nil, errors.New("mux handshake error, invalid magic")
+        }
+    }
+    setDeadline(conn, time.Time{})
+
+    this := &MuxSession{
+        conn:       conn,
+        client:     client,
+        logger:     logger,
+        streams:    make(map[uint32]*MuxStream),
+        nextId:     1,
+        idle:       time.Now(),
+        lastRecv:   time.Now().UnixNano(),
+        pongc:      make(chan uint32, 1),
+        acceptc:    make(chan *MuxStream, 64),
+        closed:     make(chan bool),
+    }
+    // the stream id of client is odd, the server is even
+    if !client {
+        this.nextId = 2
+    }
+    logger.Info("mux session [%s] established", conn.RemoteAddr())
+
+    go this.recvLoop()
+    go this.keepalive()
+    time.AfterFunc(3 * muxKeepalive, this.watchdog)
+    return this, nil
+}
+
+
+/**********************************************************************
+* @Function: (this *MuxSession) Open() (*MuxStream, error)
+* @Description: open a new stream on the session
+* @Parameter: nil
+* @Return: (*MuxStream, error), the new stream and error
+**********************************************************************/
+func (this *MuxSession) Open() (*MuxStream, error) {
+    this.mutex.Lock()
+    if this.IsClosed() || this.draining {
+        this.mutex.Unlock()
+        return nil, errors.New("mux session closed")
+    }
+    stream := newMuxStream(this, this.nextId)
+    this.nextId += 2
+    this.streams[stream.id] = stream
+    this.mutex.Unlock()
+
+    err := this.writeFrame(MUX_FRAME_OPEN, stream.id, 0, nil)
+    if err != nil {
+        this.removeStream(stream.id)
+        return nil, err
+    }
+    this.logger.Info("mux stream%d opened on [%s]", stream.id,
+                     this.conn.RemoteAddr())
+    return stream, nil
+}
+
+
+/**********************************************************************
+* @Function: (this *MuxSession) Accept() (*MuxStream, error)
+* @Description: accept the stream opened by peer
+* @Parameter: nil
+* @Return: (*MuxStream, error), the stream and error, the error is returned
+*   when the session is closed
+**********************************************************************/
+func (this *MuxSession) Accept() (*MuxStream, error) {
+    select {
+    case stream := <-this.acceptc:
+        return stream, nil
+    case <-this.closed:
+        return nil, errors.New("mux session closed")
+    }
+}
+
+
+/**********************************************************************
+* @Function: (this *MuxSession) Drain()
+* @Description: reject new streams, the session is closed after all of the
+*   streams closed
+* @Parameter: nil
+* @Return: nil
+**********************************************************************/
+func (this *MuxSession) Drain() {
+    this.mutex.Lock()
+    this.draining = true
+    empty := len(this.streams) == 0
+    this.mutex.Unlock()
+    if empty {
+        this.Close()
+    }
+}
+
+
+/**********************************************************************
+* @Function: (this *MuxSession) Close() (error)
+* @Description: close the session and all of the streams on it
+* @Parameter: nil
+* @Return: error, the error
+**********************************************************************/
+func (this *MuxSession) Close() (error) {
+    var err error = nil
+    this.closeOnce.Do(func() {
+        close(this.closed)
+        err = this.conn.Close()
+
+        this.mutex.Lock()
+        streams := this.streams
+        this.streams = make(map[uint32]*MuxStream)
+        this.mutex.Unlock()
+        for _, stream := range streams {
+            stream.remoteClose()
+        }
+        this.logger.Info("mux session [%s] closed", this.conn.RemoteAddr())
+    })
+    return err
+}
+
+
+/**********************************************************************
+* @Function: (this *MuxSession) IsClosed() (bool)
+* @Description: check whether the session has been closed
+* @Parameter: nil
+* @Return: bool, true if the session has been closed
+**********************************************************************/
+func (this *MuxSession) IsClosed() (bool) {
+    select {
+    case <-this.closed:
+        return true
+    default:
+        return false
+    }
+}
+
+
+/**********************************************************************
+* @Function: (this *MuxSession) writeFrame(typ uint8, id uint32,
+*   length uint32, payload []byte) (error)
+* @Description: write a frame to the connection
+* @Parameter: typ uint8, the frame type
+* @Parameter: id uint32, the stream id
+* @Parameter: length uint32, the payload length, or the value of frame
+* @Parameter: payload []byte, the payload of data frame
+* @Return: error, the error
+**********************************************************************/
+func (this *MuxSession) writeFrame(typ uint8, id uint32, length uint32,
+    payload []byte) (error) {
+    frame := make([]byte, muxHeaderSize, muxHeaderSize + len(payload))
+    frame[0] = typ
+    binary.BigEndian.PutUint32(frame[1:5], id)
+    binary.BigEndian.PutUint32(frame[5:9], length)
+    frame = append(frame, payload...)
+
+    this.wmutex.Lock()
+    defer this.wmutex.Unlock()
+    _, err := this.conn.Write(frame)
+    if err != nil {
+        this.Close()
+    }
+    return err
+}
+
+
+/**********************************************************************
+* @Function: (this *MuxSession) recvLoop()
+* @Description: receive frames and dispatch them to streams, the session
+*   is closed when an error occurs
+* @Parameter: nil
+* @Return: nil
+**********************************************************************/
+func (this *MuxSession) recvLoop() {
+    defer this.Close()
+
+    header := make([]byte, muxHeaderSize)
+    for {
+        _, err := io.ReadFull(this.conn, header)
+        if err != nil {
+            if !this.IsClosed() && err != io.EOF {
+                this.logger.Warn("mux session [%s] error, %s",
+                                 this.conn.RemoteAddr(), err)
+            }
+            return
+        }
+        atomic.StoreInt64(&this.lastRecv, time.Now().UnixNano())
+        typ := header[0]
+        id := binary.BigEndian.Uint32(header[1:5])
+        length := binary.BigEndian.Uint32(header[5:9])
+
+        switch typ {
+        case MUX_FRAME_DATA:
+            if length > muxFrameSize {
+                this.logger.Warn("mux session [%s] error, frame too large",
+                                 this.conn.RemoteAddr())
+                return
+            }
+            data := make([]byte, length)
+            _, err = io.ReadFull(this.conn, data)
+            if err != nil {
+                return
+            }
+            // the data of closed stream is discarded
+            stream := this.stream(id)
+            if stream != nil && !stream.push(data) {
+                this.logger.Warn("mux stream%d error, %s", id, errMuxWindow)
+                this.removeStream(id)
+                go this.writeFrame(MUX_FRAME_CLOSE, id, 0, nil)
+            }
+        case MUX_FRAME_OPEN:
+            this.accept(id)
+        case MUX_FRAME_CLOSE:
+            if stream := this.stream(id); stream != nil {
+                this.removeStream(id)
+                stream.remoteClose()
+            }
+        case MUX_FRAME_WINDOW:
+            if stream := this.stream(id); stream != nil {
+                stream.addWindow(length)
+            }
+        case MUX_FRAME_PING:
+            // the receiving must not be blocked by writing, the ping is
+            // dropped if the last one has not been answered
+            select {
+            case this.pongc <- length:
+            default:
+            }
+        case MUX_FRAME_PONG:
+        default:
+            this.logger.Warn("mux session [%s] error, unknown frame [%d]",
+                             this.conn.RemoteAddr(), typ)
+            return
+        }
+    } // end for
+}
+
+
+/**********************************************************************
+* @Function: (this *MuxSession) keepalive()
+* @Description: send ping periodically and answer the ping of peer, close
+*   the client session if it is idle
+* @Parameter: nil
+* @Return: nil
+**********************************************************************/
+func (this *MuxSession) keepalive() {
+    ticker := time.NewTicker(muxKeepalive)
+    defer ticker.Stop()
+    for {
+        select {
+        case <-this.closed:
+            return
+        case length := <-this.pongc:
+            this.writeFrame(MUX_FRAME_PONG, 0, length, nil)
+            continue
+        case <-ticker.C:
+        }
+
+        this.mutex.Lock()
+        idle := this.client && len(this.streams) == 0 &&
+                time.Since(this.idle) > muxIdleTimeout
+        this.mutex.Unlock()
+        if idle {
+            this.Close()
+            return
+        }
+        this.writeFrame(MUX_FRAME_PING, 0, 0, nil)
+    } // end for
+}
+
+
+/**********************************************************************
+* @Function: (this *MuxSession) watchdog()
+* @Description: close the session if nothing is received in 3 keepalive
+*   intervals, it runs by timer, so that it works even if the keepalive
+*   goroutine is blocked by writing to the stalled peer
+* @Parameter: nil
+* @Return: nil
+**********************************************************************/
+func (this *MuxSession) watchdog() {
+    if this.IsClosed() {
+        return
+    }
+    last := time.Unix(0, atomic.LoadInt64(&this.lastRecv))
+    wait := 3 * muxKeepalive - time.Since(last)
+    if wait <= 0 {
+        this.logger.Warn("mux session [%s] keepalive timeout",
+                         this.conn.RemoteAddr())
+        this.Close()
+        return
+    }
+    time.AfterFunc(wait, this.watchdog)
+}
+
+
+/**********************************************************************
+* @Function: (this *MuxSession) accept(id uint32)
+* @Description: create the stream opened by peer, it is rejected if the
+*   session is draining or too many streams are waiting for accepting
+* @Parameter: id uint32, the stream id
+* @Return: nil
+**********************************************************************/
+func (this *MuxSession) accept(id uint32) {
+    this.mutex.Lock()
+    if this.draining || this.streams[id] != nil {
+        this.mutex.Unlock()
+        go this.writeFrame(MUX_FRAME_CLOSE, id, 0, nil)
+        return
+    }
+    stream := newMuxStream(this, id)
+    this.streams[id] = stream
+    this.mutex.Unlock()
+
+    select {
+    case this.acceptc <- stream:
+        this.logger.Info("mux stream%d opened on [%s]", id,
+                         this.conn.RemoteAddr())
+    default:
+        // it runs on the receiving goroutine, which must not be blocked by
+        // writing, so the stream is rejected like the draining one
+        this.logger.Warn("mux stream%d rejected, too many pending streams",
+                         id)
+        this.removeStream(id)
+        go this.writeFrame(MUX_FRAME_CLOSE, id, 0, nil)
+    }
+}
+
+
+/**********************************************************************
+* @Function: (this *MuxSession) stream(id uint32) (*MuxStream)
+* @Description: get the stream by id
+* @Parameter: id uint32, the stream id
+* @Return: *MuxStream, the stream, nil if not found
+**********************************************************************/
+func (this *MuxSession) stream(id uint32) (*MuxStream) {
+    this.mutex.Lock()
+    defer this.mutex.Unlock()
+    return this.streams[id]
+}
+
+
+/**********************************************************************
+* @Function: (this *MuxSession) removeStream(id uint32)
+* @Description: remove the stream from session, the draining session is
+*   closed after the last stream removed
+* @Parameter: id uint32, the stream id
+* @Return: nil
+**********************************************************************/
+func (this *MuxSession) removeStream(id uint32) {
+    this.mutex.Lock()
+    delete(this.streams, id)
+    empty := len(this.streams) == 0
+    if empty {
+        this.idle = time.Now()
+    }
+    draining := this.draining
+    this.mutex.Unlock()
+    if empty && draining {
+        this.Close()
+    }
+}
+
+
+// the logical connection over session
+type MuxStream struct {
+    id          uint32
+    session     *MuxSession
+    mutex       sync.Mutex
+    // the received data, it never exceeds the window
+    rbuf        []byte
+    // the error of stream reset, such as the window is exceeded
+    rerr        error
+    // the consumed bytes which have not been returned to peer
+    consumed    uint32
+    // the bytes can be sent before peer returns window
+    window      uint32
+    // the stream is closed by local or peer
+    lclosed     bool
+    rclosed     bool
+    rdeadline   time.Time
+    wdeadline   time.Time
+    // wake up the blocked "Read" and "Write"
+    readc       chan bool
+    writec      chan bool
+    // the writing of a stream is serialized, so that frames are in order
+    wlock       sync.Mutex
+}
+
+
+/**********************************************************************
+* @Function: newMuxStream(session *MuxSession, id uint32) (*MuxStream)
+* @Description: initialize MuxStream structure
+* @Parameter: session *MuxSession, the session of stream
+* @Parameter: id uint32, the stream id
+* @Return: *MuxStream, the new MuxStream structure pointer
+**********************************************************************/
+func newMuxStream(session *MuxSession, id uint32) (*MuxStream) {
+    return &MuxStream{
+        id:         id,
+        session:    session,
+        window:     muxWindowSize,
+        readc:      make(chan bool, 1),
+        writec:     make(chan bool, 1),
+    }
+}
+
+
+/**********************************************************************
+* @Function: (this *MuxStream) Read(b []byte) (n int, err error)
+* @Description: read data from stream, the consumed bytes are returned to
+*   peer when they reach half of the window
+* @Parameter: b []byte, the buffer for receive data
+* @Return: (n int, err error), the length of the data read and error
+**********************************************************************/
+func (this *MuxStream) Read(b []byte) (n int, err error) {
+    for {
+        this.mutex.Lock()
+        if this.lclosed {
+            this.mutex.Unlock()
+            return 0, errMuxClosed
+        }
+        if this.rerr != nil {
+            this.mutex.Unlock()
+            return 0, this.rerr
+        }
+        if len(this.rbuf) > 0 {
+            n = copy(b, this.rbuf)
+            this.rbuf = this.rbuf[n:]
+            this.consumed += uint32(n)
+            delta := uint32(0)
+            if this.consumed >= muxWindowSize / 2 && !this.rclosed {
+                delta = this.consumed
+                this.consumed = 0
+            }
+            this.mutex.Unlock()
+            if delta > 0 {
+                this.session.writeFrame(MUX_FRAME_WINDOW, this.id, delta, nil)
+            }
+            return n, nil
+        }
+        if this.rclosed {
+            this.mutex.Unlock()
+            return 0, io.EOF
+        }
+        deadline := this.rdeadline
+        this.mutex.Unlock()
+
+        if !muxWait(this.readc, deadline) {
+            return 0, muxTimeoutError{}
+        }
+    } // end for
+}
+
+
+/**********************************************************************
+* @Function: (this *MuxStream) Write(b []byte) (n int, err error)
+* @Description: write data to stream by frames, it is blocked when the
+*   window is exhausted
+* @Parameter: b []byte, the data to be sent
+* @Return: (n int, err error), the length of the data write and error
+**********************************************************************/
+func (this *MuxStream) Write(b []byte) (n int, err error) {
+    this.wlock.Lock()
+    defer this.wlock.Unlock()
+
+    for n < len(b) {
+        this.mutex.Lock()
+        if this.rerr != nil {
+            this.mutex.Unlock()
+            return n, this.rerr
+        }
+        if this.lclosed || this.rclosed {
+            this.mutex.Unlock()
+            return n, errMuxClosed
+        }
+        if this.window == 0 {
+            deadline := this.wdeadline
+            this.mutex.Unlock()
+            if !muxWait(this.writec, deadline) {
+                return n, muxTimeoutError{}
+            }
+            continue
+        }
+        size := uint32(len(b) - n)
+        if size > this.window {
+            size = this.window
+        }
+        if size > muxFrameSize {
+            size = muxFrameSize
+        }
+        this.window -= size
+        this.mutex.Unlock()
+
+        err = this.session.writeFrame(MUX_FRAME_DATA, this.id, size,
+                                      b[n:n + int(size)])
+        if err != nil {
+            return n, err
+        }
+        n += int(size)
+    } // end for
+    return n, nil
+}
+
+
+/**********************************************************************
+* @Function: (this *MuxStream) Close() (error)
+* @Description: close the stream, and notify peer
+* @Parameter: nil
+* @Return: error, the error
+**********************************************************************/
+func (this *MuxStream) Close() (error) {
+    this.mutex.Lock()
+    if this.lclosed {
+        this.mutex.Unlock()
+        return nil
+    }
+    this.lclosed = true
+    rclosed := this.rclosed
+    this.mutex.Unlock()
+    muxNotify(this.readc)
+    muxNotify(this.writec)
+
+    // notify peer before the draining session may be closed
+    var err error = nil
+    if !rclosed {
+        err = this.session.writeFrame(MUX_FRAME_CLOSE, this.id, 0, nil)
+    }
+    this.session.removeStream(this.id)
+    this.session.logger.Info("mux stream%d closed", this.id)
+    return err
+}
+
+
+/**********************************************************************
+* @Function: (this *MuxStream) RemoteAddr() (net.Addr)
+* @Description: get the remote address of session
+* @Parameter: nil
+* @Return: net.Addr, the remote address
+**********************************************************************/
+func (this *MuxStream) RemoteAddr() (net.Addr) {
+    return this.session.conn.RemoteAddr()
+}
+
+
+/**********************************************************************
+* @Function: (this *MuxStream) LocalAddr() (net.Addr)
+* @Description: get the local address of session
+* @Parameter: nil
+* @Return: net.Addr, the local address
+**********************************************************************/
+func (this *MuxStream) LocalAddr() (net.Addr) {
+    return localAddr(this.session.conn)
+}
+
+
+/**********************************************************************
+* @Function: (this *MuxStream) SetDeadline(t time.Time) (error)
+* @Description: set the read and write deadline of stream
+* @Parameter: t time.Time, the deadline, zero means no deadline
+* @Return: error, always nil
+**********************************************************************/
+func (this *MuxStream) SetDeadline(t time.Time) (error) {
+    this.mutex.Lock()
+    this.rdeadline = t
+    this.wdeadline = t
+    this.mutex.Unlock()
+    muxNotify(this.readc)
+    muxNotify(this.writec)
+    return nil
+}
+
+
+/**********************************************************************
+* @Function: (this *MuxStream) push(data []byte) (bool)
+* @Description: receive the data from peer, the stream is reset if the
+*   received data exceeds the window, the peer does not respect it
+* @Parameter: data []byte, the payload of data frame
+* @Return: bool, false if the stream is reset
+**********************************************************************/
+func (this *MuxStream) push(data []byte) (bool) {
+    this.mutex.Lock()
+    ok := len(this.rbuf) + len(data) <= int(muxWindowSize)
+    if ok {
+        this.rbuf = append(this.rbuf, data...)
+    } else {
+        this.rbuf = nil
+        this.rerr = errMuxWindow
+        this.rclosed = true
+    }
+    this.mutex.Unlock()
+    muxNotify(this.readc)
+    if !ok {
+        muxNotify(this.writec)
+    }
+    return ok
+}
+
+
+/**********************************************************************
+* @Function: (this *MuxStream) addWindow(delta uint32)
+* @Description: the peer returns the consumed bytes
+* @Parameter: delta uint32, the consumed bytes
+* @Return: nil
+**********************************************************************/
+func (this *MuxStream) addWindow(delta uint32) {
+    this.mutex.Lock()
+    this.window += delta
+    this.mutex.Unlock()
+    muxNotify(this.writec)
+}
+
+
+/**********************************************************************
+* @Function: (this *MuxStream) remoteClose()
+* @Description: the stream is closed by peer or the session is closed, the
+*   received data can still be read
+* @Parameter: nil
+* @Return: nil
+**********************************************************************/
+func (this *MuxStream) remoteClose() {
+    this.mutex.Lock()
+    this.rclosed = true
+    this.mutex.Unlock()
+    muxNotify(this.readc)
+    muxNotify(this.writec)
+}
+
+
+/**********************************************************************
+* @Function: muxNotify(c chan bool)
+* @Description: wake up the goroutine blocked by "muxWait", it never blocks
+* @Parameter: c chan bool, the notify channel
+* @Return: nil
+**********************************************************************/
+func muxNotify(c chan bool) {
+    select {
+    case c <- true:
+    default:
+    }
+}
+
+
+/**********************************************************************
+* @Function: muxWait(c chan bool, deadline time.Time) (bool)
+* @Description: wait for the notify until deadline
+* @Parameter: c chan bool, the notify channel
+* @Parameter: deadline time.Time, the deadline, zero means no deadline
+* @Return: bool, false if the deadline exceeded
+**********************************************************************/
+func muxWait(c chan bool, deadline time.Time) (bool) {
+    if deadline.IsZero() {
+        <-c
+        return true
+    }
+    timeout := time.Until(deadline)
+    if timeout <= 0 {
+        return false
+    }
+    timer := time.NewTimer(timeout)
+    defer timer.Stop()
+    select {
+    case <-c:
+        return true
+    case <-timer.C:
+        return false
+    }
+}
+
+
+/**********************************************************************
+* @Function: ListenMux(listen ListenFunc) (ListenFunc)
+* @Description: wrap the listen function, each accepted connection is a
+*   session, and each stream of session is returned as a connection. When
+*   "ctx" is done, the sessions reject new streams and are closed after
+*   their streams closed.
+* @Parameter: listen ListenFunc, the underlying listen function
+* @Return: ListenFunc, the listen function with multiplexing
+**********************************************************************/
+func ListenMux(listen ListenFunc) (ListenFunc) {
+    return func(ctx context.Context, address string, clientc chan Conn,
+        logger Logger) {
+        // the session goroutines
+        var wg sync.WaitGroup
+        defer wg.Wait()
+
+        rawc := make(chan Conn)
+        exit := make(chan bool)
+        go func() {
+            listen(ctx, address, rawc, logger)
+            close(exit)
+        }()
+
+        for {
+            var raw Conn = nil
+            select {
+            case <-exit:
+                return
+            case raw = <-rawc:
+                if raw == nil {
+                    sendConn(ctx, clientc, nil)
+                    <-exit
+                    return
+                }
+            }
+
+            wg.Add(1)
+            go func(raw Conn) {
+                defer wg.Done()
+                session, err := NewMuxSession(raw, false, logger)
+                if err != nil {
+                    logger.Warn("client [%s] rejected, %s",
+                                raw.RemoteAddr(), err)
+                    raw.Close()
+                    return
+                }
+                go func() {
+                    select {
+                    case <-ctx.Done():
+                        session.Drain()
+                    case <-session.closed:
+                    }
+                }()
+
+                for {
+                    stream, err := session.Accept()
+                    if err != nil {
+                        return
+                    }
+                    if !sendConn(ctx, clientc, stream) {
+                        stream.Close()
+                    }
+                } // end for
+            }(raw)
+        } // end for
+    }
+}
+
+
+/**********************************************************************
+* @Function: ConnMux(dial DialFunc, logger Logger) (DialFunc)
+* @Description: wrap the dial function, one session is kept for each
+*   address, and each dial opens a new stream on it. The session is dialed
+*   again after it closed.
+* @Parameter: dial DialFunc, the underlying dial function
+* @Parameter: logger Logger, the logger of sessions
+* @Return: DialFunc, the dial function with multiplexing
+**********************************************************************/
+func ConnMux(dial DialFunc, logger Logger) (DialFunc) {
+    var mutex sync.Mutex
+    sessions := make(map[string]*MuxSession)
+    return func(address string) (Conn, error) {
+        mutex.Lock()
+        defer mutex.Unlock()
+
+        session := sessions[address]
+        if session == nil || session.IsClosed() {
+            conn, err := dial(address)
+            if err != nil {
+                return nil, err
+            }
+            session, err = NewMuxSession(conn, true, logger)
+            if err != nil {
+                conn.Close()
+                return nil, err
+            }
+            sessions[address] = session
+        }
+        return session.Open()
+    }
+}
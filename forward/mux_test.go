@@ -0,0 +1,141 @@
+/**
+* Filename: mux_test.go
+* Description: the unit tests of multiplexing layer
+* Author: knownsec404
+* Time: 2020.10.23
+*/
+
+package forward
+
+import (
+    "encoding/binary"
+    "io"
+    "net"
+    "testing"
+    "time"
+)
+
+
+/**********************************************************************
+* @Function: muxFrame(typ uint8, id uint32, length uint32,
+*   payload []byte) ([]byte)
+* @Description: encode a frame of multiplexing layer
+* @Parameter: typ uint8, the frame type
+* @Parameter: id uint32, the stream id
+* @Parameter: length uint32, the payload length, or the value of frame
+* @Parameter: payload []byte, the payload of data frame
+* @Return: []byte, the frame
+**********************************************************************/
+func muxFrame(typ uint8, id uint32, length uint32, payload []byte) ([]byte) {
+    frame := make([]byte, muxHeaderSize, muxHeaderSize + len(payload))
+    frame[0] = typ
+    binary.BigEndian.PutUint32(frame[1:5], id)
+    binary.BigEndian.PutUint32(frame[5:9], length)
+    return append(frame, payload...)
+}
+
+
+func TestMuxWindowExceeded(t *testing.T) {
+    level := GetLogLevel()
+    SetLogLevel(LOG_LEVEL_NONE)
+    defer SetLogLevel(level)
+
+    conn, peer := net.Pipe()
+    defer peer.Close()
+    peer.SetDeadline(time.Now().Add(5 * time.Second))
+
+    // the peer opens a stream and sends more than the window
+    sent := make(chan error, 1)
+    go func() {
+        _, err := peer.Write([]byte(muxMagic))
+        if err == nil {
+            _, err = peer.Write(muxFrame(MUX_FRAME_OPEN, 1, 0, nil))
+        }
+        data := make([]byte, muxFrameSize)
+        for n := uint32(0); err == nil && n <= muxWindowSize; {
+            _, err = peer.Write(muxFrame(MUX_FRAME_DATA, 1, muxFrameSize, data))
+            n += muxFrameSize
+        }
+        sent <- err
+    }()
+
+    session, err := NewMuxSession(conn, false, StdLogger{})
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer session.Close()
+    stream, err := session.Accept()
+    if err != nil {
+        t.Fatal(err)
+    }
+    err = <-sent
+    if err != nil {
+        t.Fatalf("peer write error, %s", err)
+    }
+
+    // the stream is reset and the peer is notified
+    header := make([]byte, muxHeaderSize)
+    _, err = io.ReadFull(peer, header)
+    if err != nil {
+        t.Fatalf("peer read error, %s", err)
+    }
+    if header[0] != MUX_FRAME_CLOSE || binary.BigEndian.Uint32(header[1:5]) != 1 {
+        t.Fatalf("frame = %v, want CLOSE of stream1", header)
+    }
+    _, err = stream.Read(make([]byte, 16))
+    if err != errMuxWindow {
+        t.Fatalf("Read error = %v, want %v", err, errMuxWindow)
+    }
+    _, err = stream.Write([]byte("hello"))
+    if err != errMuxWindow {
+        t.Fatalf("Write error = %v, want %v", err, errMuxWindow)
+    }
+}
+
+
+func TestMuxRejectPending(t *testing.T) {
+    level := GetLogLevel()
+    SetLogLevel(LOG_LEVEL_NONE)
+    defer SetLogLevel(level)
+
+    conn, peer := net.Pipe()
+    defer peer.Close()
+    peer.SetDeadline(time.Now().Add(5 * time.Second))
+
+    // the peer opens more streams than the pending ones, and keeps writing
+    // without reading, the receiving of session must not be blocked
+    sent := make(chan error, 1)
+    go func() {
+        _, err := peer.Write([]byte(muxMagic))
+        for id := uint32(1); err == nil && id <= 2 * 66; id += 2 {
+            _, err = peer.Write(muxFrame(MUX_FRAME_OPEN, id, 0, nil))
+        }
+        sent <- err
+    }()
+
+    session, err := NewMuxSession(conn, false, StdLogger{})
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer session.Close()
+    err = <-sent
+    if err != nil {
+        t.Fatalf("peer write error, %s", err)
+    }
+
+    // the streams beyond the pending ones are rejected
+    header := make([]byte, muxHeaderSize)
+    for i := 0; i < 2; i++ {
+        _, err = io.ReadFull(peer, header)
+        if err != nil {
+            t.Fatalf("peer read error, %s", err)
+        }
+        id := binary.BigEndian.Uint32(header[1:5])
+        if header[0] != MUX_FRAME_CLOSE || (id != 129 && id != 131) {
+            t.Fatalf("frame = %v, want CLOSE of stream129/131", header)
+        }
+    }
+    if session.stream(129) != nil || session.stream(131) != nil {
+        t.Fatal("the rejected streams are kept in session")
+    }
+}
@@ -0,0 +1,120 @@
+/**
+* Filename: retry.go
+* Description: the PortForward retry policy of dial failures, the delay is
+*   increased exponentially with jitter and capped, so that a failing peer
+*   is not hammered and a recovered peer is reached again quickly.
+* Author: knownsec404
+* Time: 2020.10.22
+*/
+
+package forward
+
+import (
+    "math"
+    "math/rand"
+    "time"
+)
+
+// the retry policy of rule, the zero field is set to default
+type RetryPolicy struct {
+    // the delay of the first retry, default is 1s
+    Initial     time.Duration
+    // the maximum delay, default is 16s
+    Max         time.Duration
+    // the delay is multiplied after each failure, default is 2
+    Multiplier  float64
+    // the delay is randomized by +/- ratio, default is 0.2
+    Jitter      float64
+    // the maximum consecutive retries of conn sock before the rule gives
+    // up, default is 0 (retry forever)
+    MaxAttempts int
+    // the retries of B point dial before the accepted A point socket is
+    // dropped, default is 0 (no retry)
+    DialRetries int
+}
+
+
+/**********************************************************************
+* @Function: (this RetryPolicy) withDefaults() (RetryPolicy)
+* @Description: set the zero field to default
+* @Parameter: nil
+* @Return: RetryPolicy, the retry policy with defaults
+**********************************************************************/
+func (this RetryPolicy) withDefaults() (RetryPolicy) {
+    if this.Initial <= 0 {
+        this.Initial = 1 * time.Second
+    }
+    if this.Max <= 0 {
+        this.Max = 16 * time.Second
+    }
+    if this.Max < this.Initial {
+        this.Max = this.Initial
+    }
+    if this.Multiplier < 1 {
+        this.Multiplier = 2
+    }
+    if this.Jitter <= 0 || this.Jitter > 1 {
+        this.Jitter = 0.2
+    }
+    return this
+}
+
+
+// the back-off state of consecutive failures
+type backoff struct {
+    policy      RetryPolicy
+    attempts    int
+}
+
+
+/**********************************************************************
+* @Function: newBackoff(policy RetryPolicy) (*backoff)
+* @Description: initialize backoff structure by retry policy
+* @Parameter: policy RetryPolicy, the retry policy
+* @Return: *backoff, the new backoff structure pointer
+**********************************************************************/
+func newBackoff(policy RetryPolicy) (*backoff) {
+    return &backoff{policy: policy.withDefaults()}
+}
+
+
+/**********************************************************************
+* @Function: (this *backoff) Next() (time.Duration)
+* @Description: record a failure and get the delay before next retry
+* @Parameter: nil
+* @Return: time.Duration, the delay
+**********************************************************************/
+func (this *backoff) Next() (time.Duration) {
+    p := this.policy
+    delay := float64(p.Initial) * math.Pow(p.Multiplier, float64(this.attempts))
+    this.attempts += 1
+    // the delay is capped after jitter, so that "Max" is never exceeded
+    delay *= 1 + p.Jitter * (rand.Float64() * 2 - 1)
+    if delay > float64(p.Max) {
+        delay = float64(p.Max)
+    }
+    return time.Duration(delay)
+}
+
+
+/**********************************************************************
+* @Function: (this *backoff) Exhausted() (bool)
+* @Description: check whether the consecutive retries reach max attempts
+* @Parameter: nil
+* @Return: bool, true if it should give up
+**********************************************************************/
+func (this *backoff) Exhausted() (bool) {
+    return this.policy.MaxAttempts > 0 &&
+           this.attempts >= this.policy.MaxAttempts
+}
+
+
+/**********************************************************************
+* @Function: (this *backoff) Reset()
+* @Description: reset the state after success
+* @Parameter: nil
+* @Return: nil
+**********************************************************************/
+func (this *backoff) Reset() {
+    this.attempts = 0
+}
@@ -0,0 +1,531 @@
+/**
+* Filename: socks5.go
+* Description: the PortForward socks5 server (RFC 1928/1929), it works as
+*   the B point of link, the A point socket speaks socks5 and the destination
+*   is chosen per link, so that one reverse tunnel can reach arbitrary hosts.
+*   CONNECT and UDP ASSOCIATE commands are supported, and the optional
+*   username/password authentication. UDP ASSOCIATE is refused when the A
+*   point socket is a tunnel, the udp relay can not be reached through it.
+* Author: knownsec404
+* Time: 2020.10.22
+*/
+
+package forward
+
+import (
+    "crypto/subtle"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "io"
+    "net"
+    "strconv"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+const (
+    SOCKS5_VERSION          byte = 0x05
+    SOCKS5_AUTH_NONE        byte = 0x00
+    SOCKS5_AUTH_PASSWORD    byte = 0x02
+    SOCKS5_AUTH_UNACCEPTED  byte = 0xff
+    SOCKS5_CMD_CONNECT      byte = 0x01
+    SOCKS5_CMD_UDP          byte = 0x03
+    SOCKS5_ATYP_IPV4        byte = 0x01
+    SOCKS5_ATYP_DOMAIN      byte = 0x03
+    SOCKS5_ATYP_IPV6        byte = 0x04
+    SOCKS5_REP_SUCCEEDED    byte = 0x00
+    SOCKS5_REP_FAILURE      byte = 0x01
+    SOCKS5_REP_UNREACHABLE  byte = 0x04
+    SOCKS5_REP_REFUSED      byte = 0x05
+    SOCKS5_REP_UNSUPPORTED  byte = 0x07
+)
+
+
+/**********************************************************************
+* @Function: Socks5Target(auth ProxyAuth, dial DialFunc, udp bool,
+*   logger Logger) (TargetFunc)
+* @Description: get the function which serves socks5 on the A point socket,
+*   and returns the socket of the requested destination as B point
+* @Parameter: auth ProxyAuth, the username/password, empty means no auth
+* @Parameter: dial DialFunc, the function to dial the destination
+* @Parameter: udp bool, support UDP ASSOCIATE, it must be false if the A
+*   point socket is not connected by the socks5 client directly
+* @Parameter: logger Logger, the logger
+* @Return: TargetFunc, the function to get the B point socket
+**********************************************************************/
+func Socks5Target(auth ProxyAuth, dial DialFunc, udp bool,
+    logger Logger) (TargetFunc) {
+    return func(sock1 Conn) (Conn, error) {
+        // the negotiation must be finished in time
+        setDeadline(sock1, time.Now().Add(10 * time.Second))
+        defer setDeadline(sock1, time.Time{})
+
+        err := socks5Auth(sock1, auth)
+        if err != nil {
+            return nil, fmt.Errorf("socks5 auth error, %s", err)
+        }
+
+        // the request: VER CMD RSV ATYP DST.ADDR DST.PORT
+        header := make([]byte, 3)
+        _, err = io.ReadFull(sock1, header)
+        if err != nil {
+            return nil, fmt.Errorf("socks5 request error, %s", err)
+        }
+        if header[0] != SOCKS5_VERSION {
+            return nil, errors.New("socks5 request error, invalid version")
+        }
+        address, err := socks5ReadAddr(sock1)
+        if err != nil {
+            return nil, fmt.Errorf("socks5 request error, %s", err)
+        }
+
+        switch header[1] {
+        case SOCKS5_CMD_CONNECT:
+            logger.Info("socks5 CONNECT [%s]", address)
+            sock2, err := dial(address)
+            if err != nil {
+                socks5Reply(sock1, socks5ErrorRep(err), nil)
+                return nil, fmt.Errorf("socks5 CONNECT [%s] error, %s",
+                                       address, err)
+            }
+            err = socks5Reply(sock1, SOCKS5_REP_SUCCEEDED, localAddr(sock2))
+            if err != nil {
+                sock2.Close()
+                return nil, err
+            }
+            return sock2, nil
+        case SOCKS5_CMD_UDP:
+            if !udp {
+                socks5Reply(sock1, SOCKS5_REP_UNSUPPORTED, nil)
+                return nil, errors.New("socks5 UDP ASSOCIATE not supported " +
+                                       "through tunnel")
+            }
+            relay, err := NewSocks5UDPRelay(sock1, logger)
+            if err != nil {
+                socks5Reply(sock1, SOCKS5_REP_FAILURE, nil)
+                return nil, fmt.Errorf("socks5 UDP ASSOCIATE error, %s", err)
+            }
+            logger.Info("socks5 UDP ASSOCIATE [%s] relay [%s]",
+                        sock1.RemoteAddr(), relay.LocalAddr())
+            err = socks5Reply(sock1, SOCKS5_REP_SUCCEEDED, relay.LocalAddr())
+            if err != nil {
+                relay.Close()
+                return nil, err
+            }
+            return relay, nil
+        default:
+            socks5Reply(sock1, SOCKS5_REP_UNSUPPORTED, nil)
+            return nil, fmt.Errorf("socks5 command [%d] not supported",
+                                   header[1])
+        }
+    }
+}
+
+
+/**********************************************************************
+* @Function: socks5Auth(conn Conn, auth ProxyAuth) (error)
+* @Description: negotiate the authentication method, and verify the
+*   username/password if it is required
+* @Parameter: conn Conn, the client socket
+* @Parameter: auth ProxyAuth, the username/password, empty means no auth
+* @Return: error, nil if the client is authenticated
+**********************************************************************/
+func socks5Auth(conn Conn, auth ProxyAuth) (error) {
+    // the greeting: VER NMETHODS METHODS
+    header := make([]byte, 2)
+    _, err := io.ReadFull(conn, header)
+    if err != nil {
+        return err
+    }
+    if header[0] != SOCKS5_VERSION {
+        return errors.New("invalid version")
+    }
+    methods := make([]byte, header[1])
+    _, err = io.ReadFull(conn, methods)
+    if err != nil {
+        return err
+    }
+
+    method := SOCKS5_AUTH_NONE
+    if auth.Username != "" {
+        method = SOCKS5_AUTH_PASSWORD
+    }
+    offered := false
+    for _, m := range methods {
+        if m == method {
+            offered = true
+        }
+    }
+    if !offered {
+        conn.Write([]byte{SOCKS5_VERSION, SOCKS5_AUTH_UNACCEPTED})
+        return errors.New("no acceptable method")
+    }
+    _, err = conn.Write([]byte{SOCKS5_VERSION, method})
+    if err != nil || method == SOCKS5_AUTH_NONE {
+        return err
+    }
+
+    // the username/password: VER ULEN UNAME PLEN PASSWD
+    ver := make([]byte, 2)
+    _, err = io.ReadFull(conn, ver)
+    if err != nil {
+        return err
+    }
+    uname := make([]byte, ver[1])
+    _, err = io.ReadFull(conn, uname)
+    if err != nil {
+        return err
+    }
+    plen := make([]byte, 1)
+    _, err = io.ReadFull(conn, plen)
+    if err != nil {
+        return err
+    }
+    passwd := make([]byte, plen[0])
+    _, err = io.ReadFull(conn, passwd)
+    if err != nil {
+        return err
+    }
+    if subtle.ConstantTimeCompare(uname, []byte(auth.Username)) != 1 ||
+        subtle.ConstantTimeCompare(passwd, []byte(auth.Password)) != 1 {
+        conn.Write([]byte{0x01, 0x01})
+        return fmt.Errorf("invalid username [%s] or password", uname)
+    }
+    _, err = conn.Write([]byte{0x01, 0x00})
+    return err
+}
+
+
+/**********************************************************************
+* @Function: socks5ReadAddr(r io.Reader) (string, error)
+* @Description: read the socks5 address: ATYP DST.ADDR DST.PORT
+* @Parameter: r io.Reader, the reader
+* @Return: (string, error), the "host:port" address and error
+**********************************************************************/
+func socks5ReadAddr(r io.Reader) (string, error) {
+    atyp := make([]byte, 1)
+    _, err := io.ReadFull(r, atyp)
+    if err != nil {
+        return "", err
+    }
+
+    var host string
+    switch atyp[0] {
+    case SOCKS5_ATYP_IPV4, SOCKS5_ATYP_IPV6:
+        ip := make([]byte, net.IPv4len)
+        if atyp[0] == SOCKS5_ATYP_IPV6 {
+            ip = make([]byte, net.IPv6len)
+        }
+        _, err = io.ReadFull(r, ip)
+        if err != nil {
+            return "", err
+        }
+        host = net.IP(ip).String()
+    case SOCKS5_ATYP_DOMAIN:
+        size := make([]byte, 1)
+        _, err = io.ReadFull(r, size)
+        if err != nil {
+            return "", err
+        }
+        domain := make([]byte, size[0])
+        _, err = io.ReadFull(r, domain)
+        if err != nil {
+            return "", err
+        }
+        host = string(domain)
+    default:
+        return "", fmt.Errorf("unknown address type [%d]", atyp[0])
+    }
+
+    port := make([]byte, 2)
+    _, err = io.ReadFull(r, port)
+    if err != nil {
+        return "", err
+    }
+    portStr := strconv.Itoa(int(binary.BigEndian.Uint16(port)))
+    return net.JoinHostPort(host, portStr), nil
+}
+
+
+/**********************************************************************
+* @Function: socks5Addr(addr net.Addr) ([]byte)
+* @Description: build the socks5 address: ATYP BND.ADDR BND.PORT
+* @Parameter: addr net.Addr, the tcp/udp address, nil means "0.0.0.0:0"
+* @Return: []byte, the socks5 address
+**********************************************************************/
+func socks5Addr(addr net.Addr) ([]byte) {
+    ip := net.IPv4zero
+    port := 0
+    switch a := addr.(type) {
+    case *net.TCPAddr:
+        ip, port = a.IP, a.Port
+    case *net.UDPAddr:
+        ip, port = a.IP, a.Port
+    }
+
+    var buf []byte
+    if ip4 := ip.To4(); ip4 != nil {
+        buf = append([]byte{SOCKS5_ATYP_IPV4}, ip4...)
+    } else {
+        buf = append([]byte{SOCKS5_ATYP_IPV6}, ip.To16()...)
+    }
+    return append(buf, byte(port >> 8), byte(port))
+}
+
+
+/**********************************************************************
+* @Function: socks5Reply(conn Conn, rep byte, addr net.Addr) (error)
+* @Description: send the reply: VER REP RSV ATYP BND.ADDR BND.PORT
+* @Parameter: conn Conn, the client socket
+* @Parameter: rep byte, the reply field
+* @Parameter: addr net.Addr, the bound address
+* @Return: error, the error
+**********************************************************************/
+func socks5Reply(conn Conn, rep byte, addr net.Addr) (error) {
+    buf := append([]byte{SOCKS5_VERSION, rep, 0x00}, socks5Addr(addr)...)
+    _, err := conn.Write(buf)
+    return err
+}
+
+
+/**********************************************************************
+* @Function: socks5ErrorRep(err error) (byte)
+* @Description: convert the dial error to reply field
+* @Parameter: err error, the dial error
+* @Return: byte, the reply field
+**********************************************************************/
+func socks5ErrorRep(err error) (byte) {
+    if e, ok := err.(net.Error); ok && e.Timeout() {
+        return SOCKS5_REP_UNREACHABLE
+    }
+    if e, ok := err.(*net.OpError); ok && e.Op == "dial" {
+        if _, ok := e.Err.(*net.DNSError); ok {
+            return SOCKS5_REP_UNREACHABLE
+        }
+        return SOCKS5_REP_REFUSED
+    }
+    return SOCKS5_REP_FAILURE
+}
+
+
+/**********************************************************************
+* @Function: localAddr(conn Conn) (net.Addr)
+* @Description: get local address of connection, if it supports
+* @Parameter: conn Conn, the connection
+* @Return: net.Addr, the local address, nil if unknown
+**********************************************************************/
+func localAddr(conn Conn) (net.Addr) {
+    if c, ok := conn.(interface{ LocalAddr() net.Addr }); ok {
+        return c.LocalAddr()
+    }
+    return nil
+}
+
+
+// the socks5 UDP relay of UDP ASSOCIATE, it works as the B point socket of
+// link, so that the relay exits when the tcp control connection closed
+type Socks5UDPRelay struct {
+    // the unix nano time of last relayed datagram, it is the first field, so
+    // that it is 64-bit aligned for atomic
+    last        int64
+    conn        *(net.UDPConn)
+    // the address of tcp control connection
+    peer        net.Addr
+    // the ip of client, only the datagram from it is relayed
+    clientIP    net.IP
+    client      *(net.UDPAddr)
+    logger      Logger
+    closed      chan bool
+    closeOnce   sync.Once
+    served      chan bool
+}
+
+
+/**********************************************************************
+* @Function: NewSocks5UDPRelay(sock1 Conn, logger Logger) (*Socks5UDPRelay, error)
+* @Description: listen udp relay on the local ip of tcp control connection,
+*   and launch relay goroutine
+* @Parameter: sock1 Conn, the tcp control connection
+* @Parameter: logger Logger, the logger
+* @Return: (*Socks5UDPRelay, error), the new Socks5UDPRelay structure
+*   pointer and error
+**********************************************************************/
+func NewSocks5UDPRelay(sock1 Conn, logger Logger) (*Socks5UDPRelay, error) {
+    laddr := &net.UDPAddr{}
+    if a, ok := localAddr(sock1).(*net.TCPAddr); ok {
+        laddr.IP = a.IP
+    }
+    conn, err := net.ListenUDP("udp", laddr)
+    if err != nil {
+        return nil, err
+    }
+
+    relay := &Socks5UDPRelay{
+        conn:       conn,
+        peer:       sock1.RemoteAddr(),
+        logger:     logger,
+        closed:     make(chan bool),
+        served:     make(chan bool),
+    }
+    if a, ok := sock1.RemoteAddr().(*net.TCPAddr); ok {
+        relay.clientIP = a.IP
+    }
+    go relay.serve()
+    return relay, nil
+}
+
+
+/**********************************************************************
+* @Function: (this *Socks5UDPRelay) serve()
+* @Description: relay the datagram between client and destinations, the
+*   datagram from client is: RSV(2) FRAG ATYP DST.ADDR DST.PORT DATA
+* @Parameter: nil
+* @Return: nil
+**********************************************************************/
+func (this *Socks5UDPRelay) serve() {
+    defer close(this.served)
+
+    buf := make([]byte, 64 * 1024)
+    for {
+        n, from, err := this.conn.ReadFromUDP(buf)
+        if err != nil {
+            return
+        }
+
+        // the datagram from client
+        isClient := this.client != nil && this.client.String() == from.String()
+        if this.client == nil &&
+            (this.clientIP == nil || this.clientIP.Equal(from.IP)) {
+            this.client = from
+            isClient = true
+        }
+        if isClient {
+            // the fragmentation is not supported, drop it
+            if n < 4 || buf[2] != 0x00 {
+                continue
+            }
+            r := &sliceReader{data: buf[3:n]}
+            address, err := socks5ReadAddr(r)
+            if err != nil {
+                continue
+            }
+            dst, err := net.ResolveUDPAddr("udp", address)
+            if err != nil {
+                this.logger.Warn("socks5 udp relay error, %s", err)
+                continue
+            }
+            this.conn.WriteToUDP(r.data, dst)
+            atomic.StoreInt64(&this.last, time.Now().UnixNano())
+            continue
+        }
+
+        // the datagram from destination
+        if this.client == nil {
+            continue
+        }
+        data := append([]byte{0x00, 0x00, 0x00}, socks5Addr(from)...)
+        data = append(data, buf[:n]...)
+        this.conn.WriteToUDP(data, this.client)
+        atomic.StoreInt64(&this.last, time.Now().UnixNano())
+    } // end for
+}
+
+
+/**********************************************************************
+* @Function: (this *Socks5UDPRelay) Read(b []byte) (n int, err error)
+* @Description: block until the relay closed, there is no data from the
+*   relay to the tcp control connection
+* @Parameter: b []byte, the buffer for receive data
+* @Return: (n int, err error), always io.EOF
+**********************************************************************/
+func (this *Socks5UDPRelay) Read(b []byte) (n int, err error) {
+    <-this.closed
+    return 0, io.EOF
+}
+
+
+/**********************************************************************
+* @Function: (this *Socks5UDPRelay) Write(b []byte) (n int, err error)
+* @Description: discard the data from the tcp control connection
+* @Parameter: b []byte, the data to be sent
+* @Return: (n int, err error), the length of the data write and error
+**********************************************************************/
+func (this *Socks5UDPRelay) Write(b []byte) (n int, err error) {
+    return len(b), nil
+}
+
+
+/**********************************************************************
+* @Function: (this *Socks5UDPRelay) Close() (error)
+* @Description: close the relay, and wait for the relay goroutine exited
+* @Parameter: nil
+* @Return: error, the error
+**********************************************************************/
+func (this *Socks5UDPRelay) Close() (error) {
+    var err error = nil
+    this.closeOnce.Do(func() {
+        close(this.closed)
+        err = this.conn.Close()
+        <-this.served
+    })
+    return err
+}
+
+
+/**********************************************************************
+* @Function: (this *Socks5UDPRelay) lastActive() (int64)
+* @Description: get the time of last relayed datagram, the datagrams do not
+*   pass through Read/Write, so the link watchdog checks it
+* @Parameter: nil
+* @Return: int64, the unix nano time, 0 if no datagram is relayed
+**********************************************************************/
+func (this *Socks5UDPRelay) lastActive() (int64) {
+    return atomic.LoadInt64(&this.last)
+}
+
+
+/**********************************************************************
+* @Function: (this *Socks5UDPRelay) RemoteAddr() (net.Addr)
+* @Description: get the client address of tcp control connection
+* @Parameter: nil
+* @Return: net.Addr, the client address
+**********************************************************************/
+func (this *Socks5UDPRelay) RemoteAddr() (net.Addr) {
+    return this.peer
+}
+
+
+/**********************************************************************
+* @Function: (this *Socks5UDPRelay) LocalAddr() (net.Addr)
+* @Description: get the local address of relay
+* @Parameter: nil
+* @Return: net.Addr, the local address
+**********************************************************************/
+func (this *Socks5UDPRelay) LocalAddr() (net.Addr) {
+    return this.conn.LocalAddr()
+}
+
+
+// the reader of byte slice, the remaining data is kept in "data"
+type sliceReader struct {
+    data        []byte
+}
+
+
+/**********************************************************************
+* @Function: (this *sliceReader) Read(b []byte) (n int, err error)
+* @Description: read data from the remaining data of slice
+* @Parameter: b []byte, the buffer for receive data
+* @Return: (n int, err error), the length of the data read, and io.EOF if
+*   no data remains
+**********************************************************************/
+func (this *sliceReader) Read(b []byte) (n int, err error) {
+    if len(this.data) == 0 {
+        return 0, io.EOF
+    }
+    n = copy(b, this.data)
+    this.data = this.data[n:]
+    return n, nil
+}
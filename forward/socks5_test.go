@@ -0,0 +1,201 @@
+/**
+* Filename: socks5_test.go
+* Description: the unit tests of socks5 server
+* Author: knownsec404
+* Time: 2020.10.23
+*/
+
+package forward
+
+import (
+    "context"
+    "encoding/binary"
+    "io"
+    "net"
+    "testing"
+    "time"
+)
+
+
+/**********************************************************************
+* @Function: socks5UDPAssociate(t *testing.T, conn net.Conn) (byte,
+*   *net.UDPAddr)
+* @Description: send UDP ASSOCIATE request without authentication
+* @Parameter: t *testing.T, the test
+* @Parameter: conn net.Conn, the connection to socks5 server
+* @Return: (byte, *net.UDPAddr), the reply field and the relay address
+**********************************************************************/
+func socks5UDPAssociate(t *testing.T, conn net.Conn) (byte, *net.UDPAddr) {
+    conn.SetDeadline(time.Now().Add(5 * time.Second))
+    _, err := conn.Write([]byte{SOCKS5_VERSION, 1, SOCKS5_AUTH_NONE})
+    if err != nil {
+        t.Fatal(err)
+    }
+    buf := make([]byte, 10)
+    _, err = io.ReadFull(conn, buf[:2])
+    if err != nil || buf[1] != SOCKS5_AUTH_NONE {
+        t.Fatalf("socks5 auth = %v, %v", buf[:2], err)
+    }
+    _, err = conn.Write([]byte{SOCKS5_VERSION, SOCKS5_CMD_UDP, 0,
+                               SOCKS5_ATYP_IPV4, 0, 0, 0, 0, 0, 0})
+    if err != nil {
+        t.Fatal(err)
+    }
+    // the reply with ipv4 BND.ADDR
+    _, err = io.ReadFull(conn, buf)
+    if err != nil {
+        t.Fatalf("socks5 reply error, %s", err)
+    }
+    relay := &net.UDPAddr{IP: net.IP(buf[4:8]),
+                          Port: int(binary.BigEndian.Uint16(buf[8:10]))}
+    return buf[1], relay
+}
+
+
+/**********************************************************************
+* @Function: testForwarder(t *testing.T, args Args) (*Forwarder)
+* @Description: start a forwarder without log, it is stopped after the
+*   test
+* @Parameter: t *testing.T, the test
+* @Parameter: args Args, the rule
+* @Return: *Forwarder, the forwarder
+**********************************************************************/
+func testForwarder(t *testing.T, args Args) (*Forwarder) {
+    level := GetLogLevel()
+    SetLogLevel(LOG_LEVEL_NONE)
+    f := NewForwarder(args)
+    err := f.Start(context.Background())
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() {
+        f.Stop()
+        f.Wait()
+        SetLogLevel(level)
+    })
+    return f
+}
+
+
+func TestSocks5UDPDirect(t *testing.T) {
+    args := testRule(t, "", "")
+    args.Method2, args.Addr2 = PORTFORWARD_SOCK_SOCKS5, ""
+    testForwarder(t, args)
+
+    var conn net.Conn
+    var err error
+    for i := 0; i < 50; i++ {
+        conn, err = net.Dial("tcp", args.Addr1)
+        if err == nil {
+            break
+        }
+        time.Sleep(20 * time.Millisecond)
+    }
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer conn.Close()
+    rep, _ := socks5UDPAssociate(t, conn)
+    if rep != SOCKS5_REP_SUCCEEDED {
+        t.Fatalf("UDP ASSOCIATE reply = %#x, want %#x", rep,
+                 SOCKS5_REP_SUCCEEDED)
+    }
+}
+
+
+func TestSocks5UDPTunnel(t *testing.T) {
+    // the tunnel peer, such as the listen<=>listen PortForward, the socks5
+    // client speaks through it
+    tunnel, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer tunnel.Close()
+    testForwarder(t, Args{
+        Protocol:   PORTFORWARD_PROTO_TCP,
+        Method1:    PORTFORWARD_SOCK_CONN,
+        Addr1:      tunnel.Addr().String(),
+        Method2:    PORTFORWARD_SOCK_SOCKS5,
+    })
+
+    conn, err := tunnel.Accept()
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer conn.Close()
+    rep, _ := socks5UDPAssociate(t, conn)
+    if rep != SOCKS5_REP_UNSUPPORTED {
+        t.Fatalf("UDP ASSOCIATE reply = %#x, want %#x", rep,
+                 SOCKS5_REP_UNSUPPORTED)
+    }
+}
+
+
+func TestSocks5UDPIdle(t *testing.T) {
+    // the udp echo server of destination
+    echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer echo.Close()
+    go func() {
+        buf := make([]byte, 1500)
+        for {
+            n, from, err := echo.ReadFromUDP(buf)
+            if err != nil {
+                return
+            }
+            echo.WriteToUDP(buf[:n], from)
+        }
+    }()
+
+    args := testRule(t, "", "")
+    args.Method2, args.Addr2 = PORTFORWARD_SOCK_SOCKS5, ""
+    args.Timeouts.Idle = 300 * time.Millisecond
+    testForwarder(t, args)
+
+    var conn net.Conn
+    for i := 0; i < 50; i++ {
+        conn, err = net.Dial("tcp", args.Addr1)
+        if err == nil {
+            break
+        }
+        time.Sleep(20 * time.Millisecond)
+    }
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer conn.Close()
+    rep, relay := socks5UDPAssociate(t, conn)
+    if rep != SOCKS5_REP_SUCCEEDED {
+        t.Fatalf("UDP ASSOCIATE reply = %#x, want %#x", rep,
+                 SOCKS5_REP_SUCCEEDED)
+    }
+    client, err := net.DialUDP("udp", nil, relay)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer client.Close()
+
+    // the relayed datagrams keep the link alive beyond the idle timeout
+    addr := echo.LocalAddr().(*net.UDPAddr)
+    datagram := append([]byte{0, 0, 0}, socks5Addr(addr)...)
+    datagram = append(datagram, "ping"...)
+    buf := make([]byte, 1500)
+    for i := 0; i < 10; i++ {
+        client.SetDeadline(time.Now().Add(time.Second))
+        _, err = client.Write(datagram)
+        if err == nil {
+            _, err = client.Read(buf)
+        }
+        if err != nil {
+            t.Fatalf("udp relay error, %s", err)
+        }
+        time.Sleep(100 * time.Millisecond)
+    }
+    conn.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+    _, err = conn.Read(buf)
+    if e, ok := err.(net.Error); !ok || !e.Timeout() {
+        t.Fatalf("control connection error = %v, want alive", err)
+    }
+}
@@ -0,0 +1,247 @@
+/**
+* Filename: stats.go
+* Description: the PortForward traffic accounting, each link counts the
+*   bytes and packets in both directions, the summary is logged when the
+*   link ends, and each rule keeps the running aggregate of its links and
+*   the counters of its listeners and dialers.
+* Author: knownsec404
+* Time: 2020.10.23
+*/
+
+package forward
+
+import (
+    "context"
+    "fmt"
+    "sync/atomic"
+    "time"
+)
+
+// the traffic of one direction, a packet is a chunk of data read from the
+// socket (the datagram of udp), the fields are updated atomically
+type Traffic struct {
+    Bytes       int64   `json:"bytes"`
+    Packets     int64   `json:"packets"`
+}
+
+// the statistics of one link
+type LinkStats struct {
+    // the traffic of "A point => B point" and "B point => A point", they
+    // are the first fields, so that they are 64-bit aligned for atomic
+    Up          Traffic     `json:"up"`
+    Down        Traffic     `json:"down"`
+    Id          int         `json:"id"`
+    Rule        string      `json:"rule"`
+    // the remote address of A point and B point socket
+    Addr1       string      `json:"addr1"`
+    Addr2       string      `json:"addr2"`
+    Start       time.Time   `json:"start"`
+    // the zero time while the link is active
+    End         time.Time   `json:"-"`
+    Reason      string      `json:"reason,omitempty"`
+}
+
+// the running aggregate of rule
+type RuleStats struct {
+    Up              Traffic `json:"up"`
+    Down            Traffic `json:"down"`
+    // the number of links have been connected
+    Links           int64   `json:"links"`
+    // the number of active links
+    Active          int64   `json:"active"`
+    // the number of connections accepted by listeners
+    Accepted        int64   `json:"accepted"`
+    // the number of failed accepts and rejected handshakes
+    AcceptFailed    int64   `json:"accept_failed"`
+    // the number of failed dials
+    DialFailed      int64   `json:"dial_failed"`
+    // the number of pending sockets reset by pairing timeout
+    PairingTimeouts int64   `json:"pairing_timeouts"`
+    // the size of udp session tables
+    UDPSessions     int64   `json:"udp_sessions"`
+}
+
+// the context key of rule statistics
+type statsKey struct{}
+
+// the statistics of listeners which does not belong to any rule
+var discardStats RuleStats
+
+
+/**********************************************************************
+* @Function: (this *Traffic) add(n int)
+* @Description: count a packet of n bytes
+* @Parameter: n int, the length of packet
+* @Return: nil
+**********************************************************************/
+func (this *Traffic) add(n int) {
+    atomic.AddInt64(&this.Bytes, int64(n))
+    atomic.AddInt64(&this.Packets, 1)
+}
+
+
+/**********************************************************************
+* @Function: (this *Traffic) load() (Traffic)
+* @Description: get the snapshot of traffic
+* @Parameter: nil
+* @Return: Traffic, the snapshot
+**********************************************************************/
+func (this *Traffic) load() (Traffic) {
+    return Traffic{
+        Bytes:      atomic.LoadInt64(&this.Bytes),
+        Packets:    atomic.LoadInt64(&this.Packets),
+    }
+}
+
+
+/**********************************************************************
+* @Function: (this *LinkStats) snapshot() (LinkStats)
+* @Description: get the snapshot of link statistics
+* @Parameter: nil
+* @Return: LinkStats, the snapshot
+**********************************************************************/
+func (this *LinkStats) snapshot() (LinkStats) {
+    return LinkStats{
+        Up:         this.Up.load(),
+        Down:       this.Down.load(),
+        Id:         this.Id,
+        Rule:       this.Rule,
+        Addr1:      this.Addr1,
+        Addr2:      this.Addr2,
+        Start:      this.Start,
+        End:        this.End,
+        Reason:     this.Reason,
+    }
+}
+
+
+/**********************************************************************
+* @Function: (this LinkStats) String() (string)
+* @Description: format the summary of link as "key=value" pairs
+* @Parameter: nil
+* @Return: string, the summary
+**********************************************************************/
+func (this LinkStats) String() (string) {
+    end := this.End
+    if end.IsZero() {
+        end = time.Now()
+    }
+    return fmt.Sprintf("link=%d rule=%q a=%s b=%s start=%s duration=%s " +
+                       "up_bytes=%d up_packets=%d down_bytes=%d " +
+                       "down_packets=%d reason=%q",
+                       this.Id, this.Rule, this.Addr1, this.Addr2,
+                       this.Start.Format(time.RFC3339),
+                       end.Sub(this.Start).Round(time.Millisecond),
+                       this.Up.Bytes, this.Up.Packets,
+                       this.Down.Bytes, this.Down.Packets, this.Reason)
+}
+
+
+/**********************************************************************
+* @Function: (this *RuleStats) snapshot() (RuleStats)
+* @Description: get the snapshot of rule statistics
+* @Parameter: nil
+* @Return: RuleStats, the snapshot
+**********************************************************************/
+func (this *RuleStats) snapshot() (RuleStats) {
+    return RuleStats{
+        Up:                 this.Up.load(),
+        Down:               this.Down.load(),
+        Links:              atomic.LoadInt64(&this.Links),
+        Active:             atomic.LoadInt64(&this.Active),
+        Accepted:           atomic.LoadInt64(&this.Accepted),
+        AcceptFailed:       atomic.LoadInt64(&this.AcceptFailed),
+        DialFailed:         atomic.LoadInt64(&this.DialFailed),
+        PairingTimeouts:    atomic.LoadInt64(&this.PairingTimeouts),
+        UDPSessions:        atomic.LoadInt64(&this.UDPSessions),
+    }
+}
+
+
+/**********************************************************************
+* @Function: (this RuleStats) String() (string)
+* @Description: format the rule statistics as "key=value" pairs
+* @Parameter: nil
+* @Return: string, the rule statistics
+**********************************************************************/
+func (this RuleStats) String() (string) {
+    return fmt.Sprintf("links=%d active=%d up_bytes=%d up_packets=%d " +
+                       "down_bytes=%d down_packets=%d", this.Links,
+                       this.Active, this.Up.Bytes, this.Up.Packets,
+                       this.Down.Bytes, this.Down.Packets)
+}
+
+
+/**********************************************************************
+* @Function: withStats(ctx context.Context, stats *RuleStats) (context.Context)
+* @Description: attach the rule statistics to the context of listeners
+* @Parameter: ctx context.Context, the parent context
+* @Parameter: stats *RuleStats, the rule statistics
+* @Return: context.Context, the context with rule statistics
+**********************************************************************/
+func withStats(ctx context.Context, stats *RuleStats) (context.Context) {
+    return context.WithValue(ctx, statsKey{}, stats)
+}
+
+
+/**********************************************************************
+* @Function: statsFrom(ctx context.Context) (*RuleStats)
+* @Description: get the rule statistics of listener from context, the
+*   counters are discarded if the listener does not belong to any rule
+* @Parameter: ctx context.Context, the context of accepting
+* @Return: *RuleStats, the rule statistics
+**********************************************************************/
+func statsFrom(ctx context.Context) (*RuleStats) {
+    stats, ok := ctx.Value(statsKey{}).(*RuleStats)
+    if !ok {
+        return &discardStats
+    }
+    return stats
+}
+
+
+// the socket which counts the data read from it
+type countConn struct {
+    Conn
+    // the traffic of link and rule
+    traffic     []*Traffic
+}
+
+
+/**********************************************************************
+* @Function: (this *countConn) Read(b []byte) (n int, err error)
+* @Description: read data and count it
+* @Parameter: b []byte, the buffer for receive data
+* @Return: (n int, err error), the length of the data read and error
+**********************************************************************/
+func (this *countConn) Read(b []byte) (n int, err error) {
+    n, err = this.Conn.Read(b)
+    if n > 0 {
+        for _, t := range this.traffic {
+            t.add(n)
+        }
+    }
+    return n, err
+}
+
+
+/**********************************************************************
+* @Function: (this *countConn) CloseWrite() (error)
+* @Description: shut down the writing side of underlying connection
+* @Parameter: nil
+* @Return: error, the error
+**********************************************************************/
+func (this *countConn) CloseWrite() (error) {
+    return closeWrite(this.Conn)
+}
+
+
+/**********************************************************************
+* @Function: (this *countConn) lastActive() (int64)
+* @Description: get the time of last activity of underlying connection
+* @Parameter: nil
+* @Return: int64, the unix nano time, 0 if it is not reported
+**********************************************************************/
+func (this *countConn) lastActive() (int64) {
+    return lastActive(this.Conn)
+}
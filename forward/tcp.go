@@ -0,0 +1,275 @@
+/**
+* Filename: tcp.go
+* Description: the PortForward tcp layer implement
+* Author: knownsec404
+* Time: 2020.09.23
+*/
+
+package forward
+
+import (
+    "context"
+    "errors"
+    "net"
+    "sync"
+    "sync/atomic"
+)
+
+
+/**********************************************************************
+* @Function: ListenTCP(ctx context.Context, address string, clientc chan Conn,
+*   logger Logger)
+* @Description: listen local tcp service with the global default timeouts
+* @Parameter: ctx context.Context, the context of accepting
+* @Parameter: address string, the local listen address
+* @Parameter: clientc chan Conn, new client connection channel
+* @Parameter: logger Logger, the logger
+* @Return: nil
+**********************************************************************/
+func ListenTCP(ctx context.Context, address string, clientc chan Conn,
+    logger Logger) {
+    Timeouts{}.ListenTCP(ctx, address, clientc, logger)
+}
+
+
+/**********************************************************************
+* @Function: (this Timeouts) ListenTCP(ctx context.Context, address string,
+*   clientc chan Conn, logger Logger)
+* @Description: listen local tcp service with the timeout settings
+* @Parameter: ctx context.Context, the context of accepting
+* @Parameter: address string, the local listen address
+* @Parameter: clientc chan Conn, new client connection channel
+* @Parameter: logger Logger, the logger
+* @Return: nil
+**********************************************************************/
+func (this Timeouts) ListenTCP(ctx context.Context, address string,
+    clientc chan Conn, logger Logger) {
+    SockOptions{Timeouts: this}.ListenTCP(ctx, address, clientc, logger)
+}
+
+
+/**********************************************************************
+* @Function: (this SockOptions) ListenTCP(ctx context.Context,
+*   address string, clientc chan Conn, logger Logger)
+* @Description: listen local tcp service with the sock options, and accept
+*   client connection, the connections are returned by channel until
+*   "ctx" is done. the tcp keepalive is set on accepted connection.
+* @Parameter: ctx context.Context, the context of accepting
+* @Parameter: address string, the local listen address
+* @Parameter: clientc chan Conn, new client connection channel
+* @Parameter: logger Logger, the logger
+* @Return: nil
+**********************************************************************/
+func (this SockOptions) ListenTCP(ctx context.Context, address string,
+    clientc chan Conn, logger Logger) {
+    addr, err := net.ResolveTCPAddr("tcp", address)
+    if err != nil {
+        logger.Error("tcp listen error, %s", err)
+        sendConn(ctx, clientc, nil)
+        return
+    }
+    config := net.ListenConfig{KeepAlive: this.Timeouts.withDefaults().Keepalive}
+    serv, err := config.Listen(context.Background(), "tcp", addr.String())
+    if err == nil && this.Backlog > 0 {
+        err = setBacklog(serv, this.Backlog)
+        if err != nil {
+            serv.Close()
+        }
+    }
+    if err != nil {
+        logger.Error("tcp listen error, %s", err)
+        sendConn(ctx, clientc, nil)
+        return
+    }
+    acceptConn(ctx, serv, clientc, logger, "tcp")
+}
+
+
+/**********************************************************************
+* @Function: acceptConn(ctx context.Context, serv net.Listener,
+*   clientc chan Conn, logger Logger, network string)
+* @Description: accept client connection of listener, the connections are
+*   returned by channel until "ctx" is done, the listener is closed when
+*   it returns
+* @Parameter: ctx context.Context, the context of accepting
+* @Parameter: serv net.Listener, the listener
+* @Parameter: clientc chan Conn, new client connection channel
+* @Parameter: logger Logger, the logger
+* @Parameter: network string, the network of listener, such as "tcp"
+* @Return: nil
+**********************************************************************/
+func acceptConn(ctx context.Context, serv net.Listener, clientc chan Conn,
+    logger Logger, network string) {
+    // the "conn" has been ready, close "serv"
+    defer serv.Close()
+
+    // close "serv" when ctx is done, so that "Accept" can exit
+    exit := make(chan bool)
+    defer close(exit)
+    go func() {
+        select {
+        case <-ctx.Done():
+            serv.Close()
+        case <-exit:
+        }
+    }()
+
+    stats := statsFrom(ctx)
+    for {
+        conn, err := serv.Accept()
+        if err != nil {
+            if ctx.Err() != nil {
+                return
+            }
+            // others error
+            atomic.AddInt64(&stats.AcceptFailed, 1)
+            logger.Error("%s listen error, %s", network, err)
+            sendConn(ctx, clientc, nil)
+            return
+        }
+
+        // new client is connected
+        atomic.AddInt64(&stats.Accepted, 1)
+        logger.Debug("client [%s] accepted", conn.RemoteAddr())
+        if !sendConn(ctx, clientc, conn) {
+            conn.Close()
+            return
+        }
+    } // end for
+}
+
+
+/**********************************************************************
+* @Function: ListenHandshake(ctx context.Context, address string,
+*   clientc chan Conn, logger Logger, listen ListenFunc,
+*   handshake HandshakeFunc)
+* @Description: accept client connection by "listen", and make handshake
+*   with each client concurrently, only the connection which succeeds
+*   handshake is returned by channel, the client which fails handshake is
+*   logged and closed.
+* @Parameter: ctx context.Context, the context of accepting
+* @Parameter: address string, the local listen address
+* @Parameter: clientc chan Conn, new client connection channel
+* @Parameter: logger Logger, the logger
+* @Parameter: listen ListenFunc, the underlying listen function
+* @Parameter: handshake HandshakeFunc, the handshake function
+* @Return: nil
+**********************************************************************/
+func ListenHandshake(ctx context.Context, address string, clientc chan Conn,
+    logger Logger, listen ListenFunc, handshake HandshakeFunc) {
+    // the handshake goroutines
+    var wg sync.WaitGroup
+    defer wg.Wait()
+
+    stats := statsFrom(ctx)
+    rawc := make(chan Conn)
+    exit := make(chan bool)
+    go func() {
+        listen(ctx, address, rawc, logger)
+        close(exit)
+    }()
+
+    for {
+        var raw Conn = nil
+        select {
+        case <-exit:
+            return
+        case raw = <-rawc:
+            if raw == nil {
+                sendConn(ctx, clientc, nil)
+                <-exit
+                return
+            }
+        }
+
+        wg.Add(1)
+        go func(raw Conn) {
+            defer wg.Done()
+            conn, err := handshake(raw)
+            if err != nil {
+                atomic.AddInt64(&stats.AcceptFailed, 1)
+                logger.Warn("client [%s] rejected, %s", raw.RemoteAddr(), err)
+                raw.Close()
+                return
+            }
+            if !sendConn(ctx, clientc, conn) {
+                conn.Close()
+            }
+        }(raw)
+    } // end for
+}
+
+
+/**********************************************************************
+* @Function: sendConn(ctx context.Context, clientc chan Conn, conn Conn) (bool)
+* @Description: send new client connection by channel, give up when "ctx"
+*   is done
+* @Parameter: ctx context.Context, the context of accepting
+* @Parameter: clientc chan Conn, new client connection channel
+* @Parameter: conn Conn, the client connection
+* @Return: bool, false if "ctx" is done
+**********************************************************************/
+func sendConn(ctx context.Context, clientc chan Conn, conn Conn) (bool) {
+    select {
+    case clientc <- conn:
+        return true
+    case <-ctx.Done():
+        return false
+    }
+}
+
+
+/**********************************************************************
+* @Function: ConnTCP(address string) (Conn, error)
+* @Description: dial to remote server with the global default timeout, and
+*   return tcp connection
+* @Parameter: address string, the remote server address that needs to be dialed
+* @Return: (Conn, error), the tcp connection and error
+**********************************************************************/
+func ConnTCP(address string) (Conn, error) {
+    return Timeouts{}.ConnTCP(address)
+}
+
+
+/**********************************************************************
+* @Function: (this Timeouts) ConnTCP(address string) (Conn, error)
+* @Description: dial to remote server with the timeout settings, and return
+*   tcp connection with tcp keepalive
+* @Parameter: address string, the remote server address that needs to be dialed
+* @Return: (Conn, error), the tcp connection and error
+**********************************************************************/
+func (this Timeouts) ConnTCP(address string) (Conn, error) {
+    timeouts := this.withDefaults()
+    dialer := net.Dialer{
+        Timeout:    timeouts.Dial,
+        KeepAlive:  timeouts.Keepalive,
+    }
+    conn, err := dialer.Dial("tcp", address)
+    if err != nil {
+        return nil, err
+    }
+
+    return conn, nil
+}
+
+
+// the connection which supports half-close, such as "*net.TCPConn"
+type closeWriter interface {
+    CloseWrite() error
+}
+
+
+/**********************************************************************
+* @Function: closeWrite(conn Conn) (error)
+* @Description: shut down the writing side of connection (tcp half-close),
+*   so that the peer receives EOF while it can still send data
+* @Parameter: conn Conn, the connection
+* @Return: error, the error if the half-close is not supported
+**********************************************************************/
+func closeWrite(conn Conn) (error) {
+    c, ok := conn.(closeWriter)
+    if !ok {
+        return errors.New("half-close not supported")
+    }
+    return c.CloseWrite()
+}
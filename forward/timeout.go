@@ -0,0 +1,277 @@
+/**
+* Filename: timeout.go
+* Description: the PortForward timeout settings, the default settings are
+*   global and each rule can override them, and the link watchdog which
+*   resets the link without traffic in both directions or living too long.
+* Author: knownsec404
+* Time: 2020.10.23
+*/
+
+package forward
+
+import (
+    "fmt"
+    "sync/atomic"
+    "time"
+)
+
+// the timeout settings of rule, the zero field is set to the global default
+type Timeouts struct {
+    // the dial timeout of tcp/udp conn sock, default is 10s
+    Dial        time.Duration
+    // the link is reset when no data is forwarded in both directions for
+    // this long, default is 0 (never), negative disables it for the rule
+    Idle        time.Duration
+    // the link is reset when it lives for this long, default is 0 (never),
+    // negative disables it for the rule
+    Lifetime    time.Duration
+    // the half-closed link is reset when the other direction does not
+    // finish for this long, default is 60s, negative disables half-close
+    Linger      time.Duration
+    // the tcp keepalive period of the sockets, default is 15s, negative
+    // disables tcp keepalive
+    Keepalive   time.Duration
+    // the maximum waiting time of pending sockets in listen<=>listen mode,
+    // default is 120s
+    Pairing     time.Duration
+    // the udp session is closed when no data is received for this long,
+    // default is 16s
+    UDPIdle     time.Duration
+    // the dialed udp connection of conn sock is closed when no data is
+    // received for this long, default is 60s
+    UDPConnIdle time.Duration
+    // the polling interval of udp listener to check the "quit" signal,
+    // default is 16s
+    AcceptPoll  time.Duration
+}
+
+// the built-in default timeout settings, it is read-only, the other
+// settings are passed by "Args.Timeouts" or "Manager.Timeouts"
+var DefaultTimeouts = Timeouts{
+    Dial:        10 * time.Second,
+    Idle:        0,
+    Lifetime:    0,
+    Linger:      60 * time.Second,
+    Keepalive:   15 * time.Second,
+    Pairing:     120 * time.Second,
+    UDPIdle:     16 * time.Second,
+    UDPConnIdle: 60 * time.Second,
+    AcceptPoll:  16 * time.Second,
+}
+
+
+/**********************************************************************
+* @Function: (this Timeouts) withDefaults() (Timeouts)
+* @Description: set the zero field to the global default
+* @Parameter: nil
+* @Return: Timeouts, the timeout settings with defaults
+**********************************************************************/
+func (this Timeouts) withDefaults() (Timeouts) {
+    if this.Dial <= 0 {
+        this.Dial = DefaultTimeouts.Dial
+    }
+    if this.Idle == 0 {
+        this.Idle = DefaultTimeouts.Idle
+    }
+    if this.Lifetime == 0 {
+        this.Lifetime = DefaultTimeouts.Lifetime
+    }
+    if this.Linger == 0 {
+        this.Linger = DefaultTimeouts.Linger
+    }
+    if this.Keepalive == 0 {
+        this.Keepalive = DefaultTimeouts.Keepalive
+    }
+    if this.Pairing <= 0 {
+        this.Pairing = DefaultTimeouts.Pairing
+    }
+    if this.UDPIdle <= 0 {
+        this.UDPIdle = DefaultTimeouts.UDPIdle
+    }
+    if this.UDPConnIdle <= 0 {
+        this.UDPConnIdle = DefaultTimeouts.UDPConnIdle
+    }
+    if this.AcceptPoll <= 0 {
+        this.AcceptPoll = DefaultTimeouts.AcceptPoll
+    }
+    return this
+}
+
+
+/**********************************************************************
+* @Function: (this Timeouts) merge(other Timeouts) (Timeouts)
+* @Description: set the zero field to the field of other settings
+* @Parameter: other Timeouts, the settings of lower priority
+* @Return: Timeouts, the merged timeout settings
+**********************************************************************/
+func (this Timeouts) merge(other Timeouts) (Timeouts) {
+    if this.Dial == 0 {
+        this.Dial = other.Dial
+    }
+    if this.Idle == 0 {
+        this.Idle = other.Idle
+    }
+    if this.Lifetime == 0 {
+        this.Lifetime = other.Lifetime
+    }
+    if this.Linger == 0 {
+        this.Linger = other.Linger
+    }
+    if this.Keepalive == 0 {
+        this.Keepalive = other.Keepalive
+    }
+    if this.Pairing == 0 {
+        this.Pairing = other.Pairing
+    }
+    if this.UDPIdle == 0 {
+        this.UDPIdle = other.UDPIdle
+    }
+    if this.UDPConnIdle == 0 {
+        this.UDPConnIdle = other.UDPConnIdle
+    }
+    if this.AcceptPoll == 0 {
+        this.AcceptPoll = other.AcceptPoll
+    }
+    return this
+}
+
+
+// the socket which forwards data by itself besides Read/Write, such as the
+// socks5 UDP relay, it reports the activity to the link watchdog
+type activeConn interface {
+    lastActive() (int64)
+}
+
+
+/**********************************************************************
+* @Function: lastActive(conn Conn) (int64)
+* @Description: get the time of last activity which is not seen by the
+*   Read/Write of socket
+* @Parameter: conn Conn, the socket
+* @Return: int64, the unix nano time, 0 if the socket does not report it
+**********************************************************************/
+func lastActive(conn Conn) (int64) {
+    c, ok := conn.(activeConn)
+    if !ok {
+        return 0
+    }
+    return c.lastActive()
+}
+
+
+// the socket which records the time of last read/write
+type idleConn struct {
+    Conn
+    // the unix nano time of last activity, it is shared by both sockets of
+    // the link
+    last        *int64
+}
+
+
+/**********************************************************************
+* @Function: (this *idleConn) Read(b []byte) (n int, err error)
+* @Description: read data and record the activity
+* @Parameter: b []byte, the buffer for receive data
+* @Return: (n int, err error), the length of the data read and error
+**********************************************************************/
+func (this *idleConn) Read(b []byte) (n int, err error) {
+    n, err = this.Conn.Read(b)
+    if n > 0 {
+        atomic.StoreInt64(this.last, time.Now().UnixNano())
+    }
+    return n, err
+}
+
+
+/**********************************************************************
+* @Function: (this *idleConn) Write(b []byte) (n int, err error)
+* @Description: write data and record the activity
+* @Parameter: b []byte, the data to be sent
+* @Return: (n int, err error), the length of the data write and error
+**********************************************************************/
+func (this *idleConn) Write(b []byte) (n int, err error) {
+    n, err = this.Conn.Write(b)
+    if n > 0 {
+        atomic.StoreInt64(this.last, time.Now().UnixNano())
+    }
+    return n, err
+}
+
+
+/**********************************************************************
+* @Function: (this *idleConn) CloseWrite() (error)
+* @Description: shut down the writing side of underlying connection
+* @Parameter: nil
+* @Return: error, the error
+**********************************************************************/
+func (this *idleConn) CloseWrite() (error) {
+    return closeWrite(this.Conn)
+}
+
+
+/**********************************************************************
+* @Function: watchLink(sock1 Conn, sock2 Conn, idle time.Duration,
+*   lifetime time.Duration, done chan bool) (Conn, Conn, func() (string))
+* @Description: wrap the sockets of link to record the activity, and get
+*   the watchdog which closes both sockets when the link is idle too long or
+*   reaches the maximum lifetime
+* @Parameter: sock1 Conn, the A point socket
+* @Parameter: sock2 Conn, the B point socket
+* @Parameter: idle time.Duration, the idle timeout, 0 means never
+* @Parameter: lifetime time.Duration, the maximum lifetime, 0 means never
+* @Parameter: done chan bool, closed when the link exits
+* @Return: (Conn, Conn, func() (string)), the wrapped sockets and watchdog,
+*   the watchdog blocks until the link exits, and returns the reason if the
+*   link is reset by it, otherwise returns ""
+**********************************************************************/
+func watchLink(sock1 Conn, sock2 Conn, idle time.Duration,
+    lifetime time.Duration, done chan bool) (Conn, Conn, func() (string)) {
+    start := time.Now()
+    last := start.UnixNano()
+    socks := []Conn{sock1, sock2}
+    if idle > 0 {
+        sock1 = &idleConn{Conn: sock1, last: &last}
+        sock2 = &idleConn{Conn: sock2, last: &last}
+    }
+
+    watchdog := func() (string) {
+        // check several times in a period, so the delay is small enough
+        interval := time.Second
+        if idle > 0 && idle / 4 < interval {
+            interval = idle / 4
+        }
+        if lifetime > 0 && lifetime / 4 < interval {
+            interval = lifetime / 4
+        }
+        if interval < 100 * time.Millisecond {
+            interval = 100 * time.Millisecond
+        }
+        ticker := time.NewTicker(interval)
+        defer ticker.Stop()
+        for {
+            select {
+            case <-done:
+                return ""
+            case now := <-ticker.C:
+                reason := ""
+                active := atomic.LoadInt64(&last)
+                for _, s := range socks {
+                    if t := lastActive(s); t > active {
+                        active = t
+                    }
+                }
+                if idle > 0 && now.Sub(time.Unix(0, active)) >= idle {
+                    reason = fmt.Sprintf("idle for %s", idle)
+                } else if lifetime > 0 && now.Sub(start) >= lifetime {
+                    reason = fmt.Sprintf("reach max lifetime %s", lifetime)
+                }
+                if reason != "" {
+                    sock1.Close()
+                    sock2.Close()
+                    return reason
+                }
+            }
+        }
+    }
+    return sock1, sock2, watchdog
+}
@@ -0,0 +1,218 @@
+/**
+* Filename: tls.go
+* Description: the PortForward tls layer implement, it works on the tcp
+*   layer, so that a listen<=>conn pair can terminate or originate TLS while
+*   "ConnectSock" relays the plaintext.
+* Author: knownsec404
+* Time: 2020.10.22
+*/
+
+package forward
+
+import (
+    "context"
+    "crypto/tls"
+    "crypto/x509"
+    "errors"
+    "fmt"
+    "io/ioutil"
+    "net"
+    "time"
+)
+
+// the TLS options of sock
+type TLSOptions struct {
+    // the certificate and private key file (PEM), it is required by
+    // tls-listen, and used as client certificate by tls-conn
+    Cert        string  `json:"cert"`
+    Key         string  `json:"key"`
+    // the CA certificate file (PEM), tls-listen verifies client certificate
+    // with it when "ClientAuth" is set, tls-conn verifies server certificate
+    // with it instead of the system roots
+    CA          string  `json:"ca"`
+    // tls-listen requires and verifies client certificate (mutual TLS)
+    ClientAuth  bool    `json:"client_auth"`
+    // tls-conn overrides the SNI and the name to verify server certificate,
+    // default is the host of address
+    ServerName  string  `json:"server_name"`
+    // tls-conn skips verifying server certificate
+    Insecure    bool    `json:"insecure"`
+}
+
+
+/**********************************************************************
+* @Function: (this TLSOptions) ServerConfig() (*tls.Config, error)
+* @Description: load certificates and build the TLS config of tls-listen
+* @Parameter: nil
+* @Return: (*tls.Config, error), the TLS config and error
+**********************************************************************/
+func (this TLSOptions) ServerConfig() (*tls.Config, error) {
+    if this.Cert == "" || this.Key == "" {
+        return nil, errors.New("tls-listen requires cert and key")
+    }
+    cert, err := tls.LoadX509KeyPair(this.Cert, this.Key)
+    if err != nil {
+        return nil, err
+    }
+    config := &tls.Config{
+        Certificates:   []tls.Certificate{cert},
+    }
+
+    if this.ClientAuth {
+        if this.CA == "" {
+            return nil, errors.New("tls client auth requires ca")
+        }
+        pool, err := loadCertPool(this.CA)
+        if err != nil {
+            return nil, err
+        }
+        config.ClientCAs = pool
+        config.ClientAuth = tls.RequireAndVerifyClientCert
+    }
+    return config, nil
+}
+
+
+/**********************************************************************
+* @Function: (this TLSOptions) ClientConfig(address string) (*tls.Config, error)
+* @Description: load certificates and build the TLS config of tls-conn
+* @Parameter: address string, the remote server address that needs to be dialed
+* @Return: (*tls.Config, error), the TLS config and error
+**********************************************************************/
+func (this TLSOptions) ClientConfig(address string) (*tls.Config, error) {
+    config := &tls.Config{
+        ServerName:         this.ServerName,
+        InsecureSkipVerify: this.Insecure,
+    }
+    if config.ServerName == "" {
+        host, _, err := net.SplitHostPort(address)
+        if err != nil {
+            return nil, err
+        }
+        config.ServerName = host
+    }
+
+    if this.Cert != "" || this.Key != "" {
+        cert, err := tls.LoadX509KeyPair(this.Cert, this.Key)
+        if err != nil {
+            return nil, err
+        }
+        config.Certificates = []tls.Certificate{cert}
+    }
+    if this.CA != "" {
+        pool, err := loadCertPool(this.CA)
+        if err != nil {
+            return nil, err
+        }
+        config.RootCAs = pool
+    }
+    return config, nil
+}
+
+
+/**********************************************************************
+* @Function: loadCertPool(filename string) (*x509.CertPool, error)
+* @Description: load the CA certificate file (PEM) as certificate pool
+* @Parameter: filename string, the CA certificate file
+* @Return: (*x509.CertPool, error), the certificate pool and error
+**********************************************************************/
+func loadCertPool(filename string) (*x509.CertPool, error) {
+    data, err := ioutil.ReadFile(filename)
+    if err != nil {
+        return nil, err
+    }
+    pool := x509.NewCertPool()
+    if !pool.AppendCertsFromPEM(data) {
+        return nil, fmt.Errorf("no certificate found in ca [%s]", filename)
+    }
+    return pool, nil
+}
+
+
+/**********************************************************************
+* @Function: ListenTLS(ctx context.Context, address string, config *tls.Config,
+*   clientc chan Conn, logger Logger)
+* @Description: listen local tls service, accept client connection by
+*   "ListenTCP", the handshake is finished before the connection is returned
+*   by channel, the client which fails handshake is logged and closed.
+* @Parameter: ctx context.Context, the context of accepting
+* @Parameter: address string, the local listen address
+* @Parameter: config *tls.Config, the TLS config of server
+* @Parameter: clientc chan Conn, new client connection channel
+* @Parameter: logger Logger, the logger
+* @Return: nil
+**********************************************************************/
+func ListenTLS(ctx context.Context, address string, config *tls.Config,
+    clientc chan Conn, logger Logger) {
+    handshake := func(raw Conn) (Conn, error) {
+        return ServerTLS(raw, config)
+    }
+    ListenHandshake(ctx, address, clientc, logger, ListenTCP, handshake)
+}
+
+
+/**********************************************************************
+* @Function: ServerTLS(raw Conn, config *tls.Config) (Conn, error)
+* @Description: terminate TLS on the accepted connection
+* @Parameter: raw Conn, the accepted tcp connection
+* @Parameter: config *tls.Config, the TLS config of server
+* @Return: (Conn, error), the tls connection and error
+**********************************************************************/
+func ServerTLS(raw Conn, config *tls.Config) (Conn, error) {
+    nc, ok := raw.(net.Conn)
+    if !ok {
+        return nil, errors.New("tls requires tcp connection")
+    }
+    conn := tls.Server(nc, config)
+    conn.SetDeadline(time.Now().Add(10 * time.Second))
+    err := conn.Handshake()
+    if err != nil {
+        return nil, fmt.Errorf("tls handshake error, %s", err)
+    }
+    conn.SetDeadline(time.Time{})
+    return conn, nil
+}
+
+
+/**********************************************************************
+* @Function: ConnTLS(address string, config *tls.Config) (Conn, error)
+* @Description: dial to remote tls server, and return tls connection after
+*   handshake
+* @Parameter: address string, the remote server address that needs to be dialed
+* @Parameter: config *tls.Config, the TLS config of client
+* @Return: (Conn, error), the tls connection and error
+**********************************************************************/
+func ConnTLS(address string, config *tls.Config) (Conn, error) {
+    conn, err := ConnTCP(address)
+    if err != nil {
+        return nil, err
+    }
+
+    return ClientTLS(conn, config)
+}
+
+
+/**********************************************************************
+* @Function: ClientTLS(raw Conn, config *tls.Config) (Conn, error)
+* @Description: originate TLS on the dialed connection, the connection is
+*   closed if the handshake fails
+* @Parameter: raw Conn, the dialed tcp connection
+* @Parameter: config *tls.Config, the TLS config of client
+* @Return: (Conn, error), the tls connection and error
+**********************************************************************/
+func ClientTLS(raw Conn, config *tls.Config) (Conn, error) {
+    nc, ok := raw.(net.Conn)
+    if !ok {
+        raw.Close()
+        return nil, errors.New("tls requires tcp connection")
+    }
+    conn := tls.Client(nc, config)
+    conn.SetDeadline(time.Now().Add(10 * time.Second))
+    err := conn.Handshake()
+    if err != nil {
+        conn.Close()
+        return nil, fmt.Errorf("tls handshake error, %s", err)
+    }
+    conn.SetDeadline(time.Time{})
+    return conn, nil
+}
@@ -5,20 +5,27 @@
 * Time: 2020.09.23
 */
 
-package main
+package forward
 
 import (
+    "context"
     "errors"
     "net"
+    "sync"
+    "sync/atomic"
     "time"
 )
 
 // as UDP client Conn
 type UDPDistribute struct {
-    Established bool
     Conn        *(net.UDPConn)
     RAddr       net.Addr
     Cache       chan []byte
+    // the session is closed when no data is received for this long
+    Idle        time.Duration
+    // closed when "Close()" is called, it is the "established" state
+    closed      chan bool
+    closeOnce   sync.Once
 }
 
 
@@ -31,27 +38,46 @@ type UDPDistribute struct {
 **********************************************************************/
 func NewUDPDistribute(conn *(net.UDPConn), addr net.Addr) (*UDPDistribute) {
     return &UDPDistribute{
-        Established: true,
         Conn:        conn,
         RAddr:       addr,
         Cache:       make(chan []byte, 16),
+        Idle:        DefaultTimeouts.withDefaults().UDPIdle,
+        closed:      make(chan bool),
     }
 }
 
 
 /**********************************************************************
 * @Function: (this *UDPDistribute) Close() (error)
-* @Description: set "Established" flag is false, the UDP service will
+* @Description: set "established" state is false, the UDP service will
 *   cleaned up according to certain conditions.
 * @Parameter: nil
 * @Return: error, the error
 **********************************************************************/
 func (this *UDPDistribute) Close() (error) {
-    this.Established = false
+    this.closeOnce.Do(func() {
+        close(this.closed)
+    })
     return nil
 }
 
 
+/**********************************************************************
+* @Function: (this *UDPDistribute) Established() (bool)
+* @Description: check whether the connection is established (not closed)
+* @Parameter: nil
+* @Return: bool, the "established" state
+**********************************************************************/
+func (this *UDPDistribute) Established() (bool) {
+    select {
+    case <-this.closed:
+        return false
+    default:
+        return true
+    }
+}
+
+
 /**********************************************************************
 * @Function: (this *UDPDistribute) Read(b []byte) (n int, err error)
 * @Description: read data from connection, due to the udp implementation of
@@ -61,13 +87,15 @@ func (this *UDPDistribute) Close() (error) {
 * @Return: (n int, err error), the length of the data read and error
 **********************************************************************/
 func (this *UDPDistribute) Read(b []byte) (n int, err error) {
-    if !this.Established {
+    if !this.Established() {
         return 0, errors.New("udp distrubute has closed")
     }
 
     select {
-    case <-time.After(16 * time.Second):
+    case <-time.After(this.Idle):
         return 0, errors.New("udp distrubute read timeout")
+    case <-this.closed:
+        return 0, errors.New("udp distrubute has closed")
     case data := <-this.Cache:
         n := len(data)
         copy(b, data)
@@ -83,7 +111,7 @@ func (this *UDPDistribute) Read(b []byte) (n int, err error) {
 * @Return: (n int, err error), the length of the data write and error
 **********************************************************************/
 func (this *UDPDistribute) Write(b []byte) (n int, err error) {
-    if !this.Established {
+    if !this.Established() {
         return 0, errors.New("udp distrubute has closed")
     }
     return this.Conn.WriteTo(b, this.RAddr)
@@ -102,35 +130,77 @@ func (this *UDPDistribute) RemoteAddr() (net.Addr) {
 
 
 /**********************************************************************
-* @Function: ListenUDP(address string, clientc chan Conn, quit chan bool)
+* @Function: ListenUDP(ctx context.Context, address string, clientc chan Conn,
+*   logger Logger)
+* @Description: listen local udp service with the global default timeouts
+* @Parameter: ctx context.Context, the context of accepting
+* @Parameter: address string, the local listen address
+* @Parameter: clientc chan Conn, new client connection channel
+* @Parameter: logger Logger, the logger
+* @Return: nil
+**********************************************************************/
+func ListenUDP(ctx context.Context, address string, clientc chan Conn,
+    logger Logger) {
+    Timeouts{}.ListenUDP(ctx, address, clientc, logger)
+}
+
+
+/**********************************************************************
+* @Function: (this Timeouts) ListenUDP(ctx context.Context, address string,
+*   clientc chan Conn, logger Logger)
 * @Description: listen local udp service, and accept client connection,
 *   initialize connection and return by channel.
 *   since udp is running as a service, it only obtains remote data through
 *   the Read* function cluster (different from tcp), so we need a temporary
 *   table to record, so that we can use the temporary table to determine
-*   whether to forward or create a new link
+*   whether to forward or create a new link.
+*   when "ctx" is done, it stops accepting new client, but keeps
+*   distributing messages until all of the established clients closed.
+* @Parameter: ctx context.Context, the context of accepting
 * @Parameter: address string, the local listen address
 * @Parameter: clientc chan Conn, new client connection channel
-* @Parameter: quit chan bool, the quit signal channel
+* @Parameter: logger Logger, the logger
 * @Return: nil
 **********************************************************************/
-func ListenUDP(address string, clientc chan Conn, quit chan bool) {
+func (this Timeouts) ListenUDP(ctx context.Context, address string,
+    clientc chan Conn, logger Logger) {
+    timeouts := this.withDefaults()
     addr, err := net.ResolveUDPAddr("udp", address)
     if err != nil {
-        LogError("udp listen error, %s", err)
-        clientc <- nil
+        logger.Error("udp listen error, %s", err)
+        sendConn(ctx, clientc, nil)
         return
     }
     serv, err := net.ListenUDP("udp", addr)
     if err != nil {
-        LogError("udp listen error, %s", err)
-        clientc <- nil
+        logger.Error("udp listen error, %s", err)
+        sendConn(ctx, clientc, nil)
         return
     }
     defer serv.Close()
 
-    // the udp distrubute table
+    // wake up "ReadFrom" when ctx is done
+    exit := make(chan bool)
+    defer close(exit)
+    go func() {
+        select {
+        case <-ctx.Done():
+            serv.SetDeadline(time.Now())
+        case <-exit:
+        }
+    }()
+
+    // the udp distrubute table, its size is reported to rule statistics
     table := make(map[string]*UDPDistribute)
+    stats := statsFrom(ctx)
+    size := 0
+    resize := func() {
+        atomic.AddInt64(&stats.UDPSessions, int64(len(table) - size))
+        size = len(table)
+    }
+    defer func() {
+        atomic.AddInt64(&stats.UDPSessions, int64(-size))
+    }()
     // NOTICE:
     // in the process of running, the table will generate invalid historical
     // data, we have not cleaned it up(These invalid historical data will not
@@ -142,7 +212,7 @@ func ListenUDP(address string, clientc chan Conn, quit chan bool) {
     // coroutine is needed. Currently we think it is unnecessary.
     //
     // under the current code logic: if a udp connection exits, it will timeout
-    // to trigger "Close()", and finally set "Established" to false, but there
+    // to trigger "Close()", and finally set "established" to false, but there
     // is no logic to check this state to clean up, so invalid historical data
     // is generated (of course, we can traverse to clean up? every packet? no)
     //
@@ -152,15 +222,31 @@ func ListenUDP(address string, clientc chan Conn, quit chan bool) {
     // can create a communication link.
 
     for {
-        // check quit
-        select {
-        case <-quit:
-            return
-        default:
+        // check quit, when closing we traverse the table to clean up, and
+        // exit after all of the established clients closed
+        closing := ctx.Err() != nil
+        if closing {
+            for k, d := range table {
+                if !d.Established() {
+                    delete(table, k)
+                }
+            }
+            resize()
+            if len(table) == 0 {
+                return
+            }
         }
 
         // set timeout, for check "quit" signal
-        serv.SetDeadline(time.Now().Add(16 * time.Second))
+        if closing {
+            serv.SetDeadline(time.Now().Add(1 * time.Second))
+        } else {
+            serv.SetDeadline(time.Now().Add(timeouts.AcceptPoll))
+            // ctx is done before the deadline was reset, check it again
+            if ctx.Err() != nil {
+                continue
+            }
+        }
 
         // just new 32*1024, in the outer layer we used "io.Copy()", which
         // can only handle the size of 32*1024
@@ -170,40 +256,70 @@ func ListenUDP(address string, clientc chan Conn, quit chan bool) {
             if err, ok := err.(net.Error); ok && err.Timeout() {
                 continue
             }
-            LogError("udp listen error, %s", err)
-            clientc <- nil
+            atomic.AddInt64(&stats.AcceptFailed, 1)
+            logger.Error("udp listen error, %s", err)
+            sendConn(ctx, clientc, nil)
             return
         }
         buf = buf[:n]
 
         // if the address in table, we distrubute message
         if d, ok := table[addr.String()]; ok {
-            if d.Established {
+            if d.Established() {
                 // it is established, distrubute message
-                d.Cache <- buf
+                select {
+                case d.Cache <- buf:
+                case <-d.closed:
+                }
                 continue
             } else {
                 // we remove it when the connnection has expired
                 delete(table, addr.String())
+                resize()
+                logger.Debug("udp session [%s] expired", addr)
             }
         }
+        // stop accepting new client when closing
+        if closing {
+            continue
+        }
         // if the address not in table, we create new connection object
         conn := NewUDPDistribute(serv, addr)
+        conn.Idle = timeouts.UDPIdle
         table[addr.String()] = conn
+        resize()
+        atomic.AddInt64(&stats.Accepted, 1)
+        logger.Debug("udp session [%s] created, %d sessions", addr, len(table))
         conn.Cache <- buf
-        clientc <- conn
+        if !sendConn(ctx, clientc, conn) {
+            conn.Close()
+        }
     } // end for
 }
 
 
 /**********************************************************************
 * @Function: ConnUDP(address string) (Conn, error)
-* @Description: dial to remote server, and return udp connection
+* @Description: dial to remote server with the global default timeouts, and
+*   return udp connection
 * @Parameter: address string, the remote server address that needs to be dialed
 * @Return: (Conn, error), the udp connection and error
 **********************************************************************/
 func ConnUDP(address string) (Conn, error) {
-    conn, err := net.DialTimeout("udp", address, 10 * time.Second)
+    return Timeouts{}.ConnUDP(address)
+}
+
+
+/**********************************************************************
+* @Function: (this Timeouts) ConnUDP(address string) (Conn, error)
+* @Description: dial to remote server with the timeout settings, and return
+*   udp connection
+* @Parameter: address string, the remote server address that needs to be dialed
+* @Return: (Conn, error), the udp connection and error
+**********************************************************************/
+func (this Timeouts) ConnUDP(address string) (Conn, error) {
+    timeouts := this.withDefaults()
+    conn, err := net.DialTimeout("udp", address, timeouts.Dial)
     if err != nil {
         return nil, err
     }
@@ -211,12 +327,32 @@ func ConnUDP(address string) (Conn, error) {
     // send one byte(knock) to server, get "established" udp connection
     _, err = conn.Write([]byte("\x00"))
     if err != nil {
+        conn.Close()
         return nil, err
     }
 
     // due to the characteristics of udp, when the udp server exits, we will
     // not receive any signal, it will be blocked at conn.Read();
-    // here we set a timeout for udp
-    conn.SetDeadline(time.Now().Add(60 * time.Second))
-    return conn, nil
+    // here we set an idle timeout for udp
+    return &udpConn{Conn: conn, idle: timeouts.UDPConnIdle}, nil
+}
+
+
+// the dialed udp connection, the read deadline is extended by each read
+type udpConn struct {
+    net.Conn
+    idle        time.Duration
+}
+
+
+/**********************************************************************
+* @Function: (this *udpConn) Read(b []byte) (n int, err error)
+* @Description: read data from connection, it fails when no data is received
+*   for the idle time
+* @Parameter: b []byte, the buffer for receive data
+* @Return: (n int, err error), the length of the data read and error
+**********************************************************************/
+func (this *udpConn) Read(b []byte) (n int, err error) {
+    this.Conn.SetReadDeadline(time.Now().Add(this.idle))
+    return this.Conn.Read(b)
 }
@@ -0,0 +1,73 @@
+/**
+* Filename: unix.go
+* Description: the PortForward unix socket layer implement, the address of
+*   unix sock is the socket path, such as "/run/pf.sock"
+* Author: knownsec404
+* Time: 2020.10.23
+*/
+
+package forward
+
+import (
+    "context"
+    "net"
+    "os"
+)
+
+
+/**********************************************************************
+* @Function: (this SockOptions) ListenUnix(ctx context.Context,
+*   address string, clientc chan Conn, logger Logger)
+* @Description: listen local unix socket, and accept client connection,
+*   the connections are returned by channel until "ctx" is done. the
+*   socket left by the last process is removed before listening, and the
+*   socket is removed after the listener is closed
+* @Parameter: ctx context.Context, the context of accepting
+* @Parameter: address string, the socket path
+* @Parameter: clientc chan Conn, new client connection channel
+* @Parameter: logger Logger, the logger
+* @Return: nil
+**********************************************************************/
+func (this SockOptions) ListenUnix(ctx context.Context, address string,
+    clientc chan Conn, logger Logger) {
+    if info, err := os.Stat(address); err == nil &&
+       info.Mode() & os.ModeSocket != 0 {
+        os.Remove(address)
+    }
+    serv, err := net.Listen("unix", address)
+    if err == nil && this.Mode != 0 {
+        err = os.Chmod(address, this.Mode)
+        if err != nil {
+            serv.Close()
+        }
+    }
+    if err == nil && this.Backlog > 0 {
+        err = setBacklog(serv, this.Backlog)
+        if err != nil {
+            serv.Close()
+        }
+    }
+    if err != nil {
+        logger.Error("unix listen error, %s", err)
+        sendConn(ctx, clientc, nil)
+        return
+    }
+    acceptConn(ctx, serv, clientc, logger, "unix")
+}
+
+
+/**********************************************************************
+* @Function: (this Timeouts) ConnUnix(address string) (Conn, error)
+* @Description: dial to local unix socket with the timeout settings, and
+*   return unix connection
+* @Parameter: address string, the socket path
+* @Return: (Conn, error), the unix connection and error
+**********************************************************************/
+func (this Timeouts) ConnUnix(address string) (Conn, error) {
+    timeouts := this.withDefaults()
+    conn, err := net.DialTimeout("unix", address, timeouts.Dial)
+    if err != nil {
+        return nil, err
+    }
+    return conn, nil
+}
@@ -0,0 +1,243 @@
+/**
+* Filename: upstream.go
+* Description: the PortForward upstream proxy, the tcp connection of conn
+*   sock is dialed through a chain of upstream proxies instead of dialing the
+*   address directly, so that the restricted host whose only egress is a
+*   proxy can still work. The proxy is written as url:
+*   1.socks5://[user:pass@]host:port
+*   2.http://[user:pass@]host:port, the tunnel is built by "CONNECT"
+* Author: knownsec404
+* Time: 2020.10.22
+*/
+
+package forward
+
+import (
+    "bufio"
+    "bytes"
+    "encoding/base64"
+    "errors"
+    "fmt"
+    "io"
+    "net"
+    "net/http"
+    "net/url"
+    "strconv"
+    "time"
+)
+
+
+/**********************************************************************
+* @Function: ParseUpstream(proxy string) (*url.URL, error)
+* @Description: parse and check the upstream proxy url
+* @Parameter: proxy string, the proxy url
+* @Return: (*url.URL, error), the proxy url and error
+**********************************************************************/
+func ParseUpstream(proxy string) (*url.URL, error) {
+    u, err := url.Parse(proxy)
+    if err != nil {
+        return nil, err
+    }
+    if u.Scheme != "socks5" && u.Scheme != "http" {
+        return nil, fmt.Errorf("unknown upstream proxy scheme [%s]", u.Scheme)
+    }
+    _, _, err = net.SplitHostPort(u.Host)
+    if err != nil {
+        return nil, fmt.Errorf("upstream proxy [%s] error, %s", u.Host, err)
+    }
+    return u, nil
+}
+
+
+/**********************************************************************
+* @Function: ConnUpstream(chain []string, dial DialFunc) (DialFunc, error)
+* @Description: get the function which dials through the upstream proxies,
+*   the first proxy is dialed directly, then each proxy builds the tunnel
+*   to the next one, and the last one builds the tunnel to the address
+* @Parameter: chain []string, the upstream proxy urls in order
+* @Parameter: dial DialFunc, the function to dial the first proxy directly
+* @Return: (DialFunc, error), the dial function and error
+**********************************************************************/
+func ConnUpstream(chain []string, dial DialFunc) (DialFunc, error) {
+    proxies := make([]*url.URL, 0, len(chain))
+    for _, proxy := range chain {
+        u, err := ParseUpstream(proxy)
+        if err != nil {
+            return nil, err
+        }
+        proxies = append(proxies, u)
+    }
+    if len(proxies) == 0 {
+        return dial, nil
+    }
+
+    return func(address string) (Conn, error) {
+        conn, err := dial(proxies[0].Host)
+        if err != nil {
+            return nil, err
+        }
+
+        // the tunnel must be built in time
+        setDeadline(conn, time.Now().Add(10 * time.Second))
+        for i, proxy := range proxies {
+            next := address
+            if i + 1 < len(proxies) {
+                next = proxies[i + 1].Host
+            }
+            if proxy.Scheme == "socks5" {
+                err = socks5Connect(conn, proxy, next)
+            } else {
+                err = httpConnect(conn, proxy, next)
+            }
+            if err != nil {
+                conn.Close()
+                return nil, fmt.Errorf("upstream proxy [%s] error, %s",
+                                       proxy.Host, err)
+            }
+        }
+        setDeadline(conn, time.Time{})
+        return conn, nil
+    }, nil
+}
+
+
+/**********************************************************************
+* @Function: socks5Connect(conn Conn, proxy *url.URL, address string) (error)
+* @Description: build the tunnel to address by socks5 CONNECT command
+* @Parameter: conn Conn, the connection to socks5 proxy
+* @Parameter: proxy *url.URL, the socks5 proxy url
+* @Parameter: address string, the "host:port" address
+* @Return: error, the error
+**********************************************************************/
+func socks5Connect(conn Conn, proxy *url.URL, address string) (error) {
+    host, portStr, err := net.SplitHostPort(address)
+    if err != nil {
+        return err
+    }
+    port, err := strconv.Atoi(portStr)
+    if err != nil || port < 0 || port > 0xffff {
+        return fmt.Errorf("invalid port [%s]", portStr)
+    }
+
+    // the greeting, offer username/password if it is given
+    greeting := []byte{SOCKS5_VERSION, 0x01, SOCKS5_AUTH_NONE}
+    if proxy.User != nil {
+        greeting = []byte{SOCKS5_VERSION, 0x02, SOCKS5_AUTH_NONE,
+                          SOCKS5_AUTH_PASSWORD}
+    }
+    _, err = conn.Write(greeting)
+    if err != nil {
+        return err
+    }
+    reply := make([]byte, 2)
+    _, err = io.ReadFull(conn, reply)
+    if err != nil {
+        return err
+    }
+    if reply[0] != SOCKS5_VERSION {
+        return errors.New("invalid socks5 version")
+    }
+    switch reply[1] {
+    case SOCKS5_AUTH_NONE:
+    case SOCKS5_AUTH_PASSWORD:
+        if proxy.User == nil {
+            return errors.New("socks5 auth required")
+        }
+        username := proxy.User.Username()
+        password, _ := proxy.User.Password()
+        if len(username) > 255 || len(password) > 255 {
+            return errors.New("socks5 username or password too long")
+        }
+        buf := append([]byte{0x01, byte(len(username))}, username...)
+        buf = append(buf, byte(len(password)))
+        buf = append(buf, password...)
+        _, err = conn.Write(buf)
+        if err != nil {
+            return err
+        }
+        _, err = io.ReadFull(conn, reply)
+        if err != nil {
+            return err
+        }
+        if reply[1] != 0x00 {
+            return errors.New("socks5 auth failed")
+        }
+    default:
+        return errors.New("socks5 no acceptable method")
+    }
+
+    // the request: VER CMD RSV ATYP DST.ADDR DST.PORT
+    request := []byte{SOCKS5_VERSION, SOCKS5_CMD_CONNECT, 0x00}
+    if ip := net.ParseIP(host); ip == nil {
+        if len(host) > 255 {
+            return errors.New("socks5 domain too long")
+        }
+        request = append(request, SOCKS5_ATYP_DOMAIN, byte(len(host)))
+        request = append(request, host...)
+    } else if ip4 := ip.To4(); ip4 != nil {
+        request = append(request, SOCKS5_ATYP_IPV4)
+        request = append(request, ip4...)
+    } else {
+        request = append(request, SOCKS5_ATYP_IPV6)
+        request = append(request, ip.To16()...)
+    }
+    request = append(request, byte(port >> 8), byte(port))
+    _, err = conn.Write(request)
+    if err != nil {
+        return err
+    }
+
+    // the reply: VER REP RSV ATYP BND.ADDR BND.PORT
+    header := make([]byte, 3)
+    _, err = io.ReadFull(conn, header)
+    if err != nil {
+        return err
+    }
+    if header[1] != SOCKS5_REP_SUCCEEDED {
+        return fmt.Errorf("socks5 CONNECT [%s] failed, reply [%d]",
+                          address, header[1])
+    }
+    _, err = socks5ReadAddr(conn)
+    return err
+}
+
+
+/**********************************************************************
+* @Function: httpConnect(conn Conn, proxy *url.URL, address string) (error)
+* @Description: build the tunnel to address by HTTP CONNECT request
+* @Parameter: conn Conn, the connection to http proxy
+* @Parameter: proxy *url.URL, the http proxy url
+* @Parameter: address string, the "host:port" address
+* @Return: error, the error
+**********************************************************************/
+func httpConnect(conn Conn, proxy *url.URL, address string) (error) {
+    var request bytes.Buffer
+    fmt.Fprintf(&request, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n",
+                address, address)
+    if proxy.User != nil {
+        password, _ := proxy.User.Password()
+        token := base64.StdEncoding.EncodeToString(
+                     []byte(proxy.User.Username() + ":" + password))
+        fmt.Fprintf(&request, "Proxy-Authorization: Basic %s\r\n", token)
+    }
+    request.WriteString("\r\n")
+    _, err := conn.Write(request.Bytes())
+    if err != nil {
+        return err
+    }
+
+    // read the response header only, the data after it belongs to tunnel
+    header, err := httpReadHeader(conn)
+    if err != nil {
+        return err
+    }
+    resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(header)),
+                                   nil)
+    if err != nil {
+        return err
+    }
+    if resp.StatusCode != http.StatusOK {
+        return fmt.Errorf("http CONNECT [%s] failed, %s", address, resp.Status)
+    }
+    return nil
+}
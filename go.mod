@@ -1,3 +1,3 @@
-module main
+module github.com/knownsec/PortForward
 
 go 1.14
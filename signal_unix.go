@@ -0,0 +1,18 @@
+// +build !windows
+
+/**
+* Filename: signal_unix.go
+* Description: the signals of unix
+* Author: knownsec404
+* Time: 2020.10.23
+*/
+
+package main
+
+import (
+    "os"
+    "syscall"
+)
+
+// the signal to reopen log files
+var reopenSignals = []os.Signal{syscall.SIGUSR1}
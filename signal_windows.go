@@ -0,0 +1,16 @@
+/**
+* Filename: signal_windows.go
+* Description: the signals of windows, there is no signal to reopen log
+*   files
+* Author: knownsec404
+* Time: 2020.10.23
+*/
+
+package main
+
+import (
+    "os"
+)
+
+// the signal to reopen log files
+var reopenSignals = []os.Signal{}